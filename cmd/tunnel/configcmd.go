@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"icmp-tunnel/config"
+)
+
+const configUsage = `usage:
+  tunnel config init [-mode agent|server] [-server addr] [-o file] [-force]
+  tunnel config check [file ...]
+`
+
+// configMain runs the "tunnel config" subcommands and returns the exit
+// status.
+func configMain(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	switch args[0] {
+	case "init":
+		return configInit(args[1:])
+	case "check":
+		return configCheck(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "tunnel config: unknown command %q\n%s", args[0], configUsage)
+	return 2
+}
+
+func configInit(args []string) int {
+	fs := flag.NewFlagSet("tunnel config init", flag.ContinueOnError)
+	mode := fs.String("mode", "agent", "role of the new config: \"agent\" or \"server\"")
+	server := fs.String("server", "127.0.0.1", "tunnel server address (agent mode)")
+	out := fs.String("o", "", "write to file instead of standard output")
+	force := fs.Bool("force", false, "overwrite an existing file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	data, err := config.Starter(*mode, *server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tunnel config init: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	// the file holds the key
+	f, err := os.OpenFile(*out, flags, 0o600)
+	if err == nil {
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tunnel config init: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s configuration to %s\n", *mode, *out)
+	return 0
+}
+
+func configCheck(args []string) int {
+	if len(args) == 0 {
+		if p := defaultPath(); p != "" {
+			args = []string{p}
+		} else {
+			fmt.Fprint(os.Stderr, configUsage)
+			return 2
+		}
+	}
+	status := 0
+	for _, path := range args {
+		problems, err := config.Check(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", path)
+			continue
+		}
+		status = 1
+		for _, p := range problems {
+			if p.Line == 0 {
+				fmt.Printf("%s: %v\n", path, p.Err)
+				continue
+			}
+			fmt.Printf("%s:%d: %v\n", path, p.Line, p.Err)
+			fmt.Printf("    %4d | %s\n", p.Line, strings.TrimRight(p.Text, "\r"))
+		}
+	}
+	return status
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"icmp-tunnel/config"
+	"icmp-tunnel/icmp/client"
+	"icmp-tunnel/icmp/server"
+)
+
+const icmpUsage = `usage:
+  tunnel icmp proxy -server ip [-listen addr] [key flags]
+  tunnel icmp forward -target addr [-max-sessions n] [-max-per-source n] [-idle d] [key flags]
+`
+
+// icmpMain runs the "tunnel icmp" subcommands, a plain UDP relay over ICMP
+// echo: proxy serves a local UDP port on the client host, forward hands
+// what it carries to a UDP service on the server host. It returns the exit
+// status.
+func icmpMain(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, icmpUsage)
+		return 2
+	}
+	switch args[0] {
+	case "proxy":
+		return icmpProxy(args[1:])
+	case "forward":
+		return icmpForward(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "tunnel icmp: unknown command %q\n%s", args[0], icmpUsage)
+	return 2
+}
+
+func icmpProxy(args []string) int {
+	fs := flag.NewFlagSet("tunnel icmp proxy", flag.ContinueOnError)
+	serverIP := fs.String("server", "", "IPv4 address of the ICMP server")
+	listen := fs.String("listen", ":9000", "local UDP address to forward")
+	ks := keyFlags(fs)
+	psk, status := parseICMPFlags(fs, args, ks)
+	if psk == nil {
+		return status
+	}
+	if *serverIP == "" {
+		fmt.Fprintf(os.Stderr, "tunnel icmp proxy: -server is required\n")
+		return 2
+	}
+
+	p, err := client.ListenProxy(*serverIP, *listen, psk)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tunnel icmp proxy: %v\n", err)
+		return 1
+	}
+	log.Printf("forwarding udp %s to %s over icmp", p.Addr(), *serverIP)
+	return untilSignal(p)
+}
+
+func icmpForward(args []string) int {
+	fs := flag.NewFlagSet("tunnel icmp forward", flag.ContinueOnError)
+	target := fs.String("target", "", "UDP service every client session is forwarded to")
+	var limits server.Limits
+	fs.IntVar(&limits.MaxSessions, "max-sessions", 0, "sessions forwarded at once (default 1024)")
+	fs.IntVar(&limits.MaxPerSource, "max-per-source", 0, "sessions one client address may hold (default 64)")
+	fs.DurationVar(&limits.Idle, "idle", 0, "close sessions idle for this long (default 2m)")
+	ks := keyFlags(fs)
+	psk, status := parseICMPFlags(fs, args, ks)
+	if psk == nil {
+		return status
+	}
+	if *target == "" {
+		fmt.Fprintf(os.Stderr, "tunnel icmp forward: -target is required\n")
+		return 2
+	}
+
+	f, err := server.Forward(*target, psk, limits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tunnel icmp forward: %v\n", err)
+		return 1
+	}
+	log.Printf("forwarding icmp sessions to udp %s", *target)
+	return untilSignal(f)
+}
+
+// keyFlags registers the flags naming the pre-shared key on fs.
+func keyFlags(fs *flag.FlagSet) *config.KeySource {
+	var ks config.KeySource
+	fs.StringVar(&ks.Key, "key", "", "pre-shared key (\"hex:\" and \"base64:\" prefixes are decoded)")
+	fs.StringVar(&ks.KeyFile, "key-file", "", "file holding the pre-shared key")
+	fs.StringVar(&ks.KeyEnv, "key-env", "", "environment variable holding the pre-shared key")
+	fs.StringVar(&ks.KeyCommand, "key-command", "", "command printing the pre-shared key, run once with sh -c")
+	fs.StringVar(&ks.KDF.Algorithm, "kdf-algorithm", "", "derive the key from a passphrase with \"scrypt\" or \"argon2id\"")
+	fs.StringVar(&ks.KDF.Salt, "kdf-salt", "", "salt for -kdf-algorithm")
+	return &ks
+}
+
+// parseICMPFlags parses args on top of the TUNNEL_* environment and
+// resolves the key. Without a key to go on with, after -print-config or an
+// error it reports, it returns the exit status.
+func parseICMPFlags(fs *flag.FlagSet, args []string, ks *config.KeySource) ([]byte, int) {
+	printConfig := fs.Bool("print-config", false, "print the effective settings and exit")
+	// defaults < TUNNEL_* environment < flags
+	env, err := config.ApplyEnv(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Name(), err)
+		return nil, 2
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, 2
+	}
+	if *printConfig {
+		config.PrintFlags(os.Stdout, fs, env)
+		return nil, 0
+	}
+	psk, err := ks.ResolveKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Name(), err)
+		return nil, 1
+	}
+	return psk, 0
+}
+
+// untilSignal runs until SIGINT or SIGTERM, then closes c.
+func untilSignal(c io.Closer) int {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("stopping on %v", <-sig)
+	if err := c.Close(); err != nil {
+		log.Printf("close: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"icmp-tunnel/config"
+	"icmp-tunnel/tunnel"
+)
+
+// role is the running agent or server of one tunnel.
+type role interface {
+	Reload(t *config.Tunnel) error
+	Close() error
+}
+
+type running struct {
+	t    *config.Tunnel
+	role role
+}
+
+func start(t *config.Tunnel) (role, error) {
+	if t.Mode == "server" {
+		return tunnel.NewServer(t)
+	}
+	return tunnel.NewAgent(t)
+}
+
+func defaultPath() string {
+	if p := os.Getenv("TUNNEL_CONFIG"); p != "" {
+		return p
+	}
+	return os.Getenv("CONFIG_PATH")
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "icmp" {
+		os.Exit(icmpMain(os.Args[2:]))
+	}
+
+	path := flag.String("config", defaultPath(), "config file (default $TUNNEL_CONFIG or $CONFIG_PATH)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flagOverrides := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// defaults < file < TUNNEL_* environment < flags
+	overrides := append(config.EnvOverrides(os.Environ()), flagOverrides()...)
+	cfg, err := config.LoadLayered(*path, overrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *path != "" {
+		log.Printf("loaded configuration from %s", *path)
+	}
+
+	tunnels := make(map[string]running)
+	for _, t := range cfg.Tunnels() {
+		r, err := start(t)
+		if err != nil {
+			log.Fatalf("[%s] %v", t.Name, err)
+		}
+		log.Printf("[%s] started %s over %s", t.Name, t.Mode, t.Transport)
+		tunnels[t.Name] = running{t, r}
+	}
+
+	// tunnels follow the file: on every write and on SIGHUP
+	var mu sync.Mutex
+	reload := func(next *config.Config, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Printf("reload: %v", err)
+			return
+		}
+		seen := make(map[string]bool)
+		for _, t := range next.Tunnels() {
+			seen[t.Name] = true
+			cur, ok := tunnels[t.Name]
+			if ok && !cur.t.NeedsRestart(t) {
+				if err := cur.role.Reload(t); err != nil {
+					log.Printf("[%s] reload: %v", t.Name, err)
+				}
+				tunnels[t.Name] = running{t, cur.role}
+				continue
+			}
+			if ok {
+				// the carrier, server or key changed under the tunnel
+				cur.role.Close()
+				log.Printf("[%s] stopped %s", t.Name, cur.t.Mode)
+			}
+			r, err := start(t)
+			if err != nil {
+				log.Printf("[%s] reload: %v", t.Name, err)
+				delete(tunnels, t.Name)
+				continue
+			}
+			log.Printf("[%s] started %s over %s", t.Name, t.Mode, t.Transport)
+			tunnels[t.Name] = running{t, r}
+		}
+		for name, cur := range tunnels {
+			if !seen[name] {
+				cur.role.Close()
+				delete(tunnels, name)
+				log.Printf("[%s] stopped %s", name, cur.t.Mode)
+			}
+		}
+	}
+	if *path != "" {
+		if err := config.Watch(*path, overrides, reload); err != nil {
+			log.Fatal(err)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("reload: SIGHUP")
+		reload(config.LoadLayered(*path, overrides))
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Problem is one error found in a configuration file.
+type Problem struct {
+	// Line is the 1-based line the problem concerns, 0 if it has none.
+	Line int
+	// Text is the content of that line.
+	Text string
+	Err  error
+}
+
+func (p Problem) Error() string {
+	if p.Line == 0 {
+		return p.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %v", p.Line, p.Err)
+}
+
+// Check loads the file at path like Load and returns every problem in it,
+// each placed at the line it concerns when possible. The error is only
+// set when the file cannot be read at all.
+func Check(path string) ([]Problem, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(src), "\n")
+	at := func(line int, err error) Problem {
+		p := Problem{Err: err}
+		if line > 0 && line <= len(lines) {
+			p.Line, p.Text = line, lines[line-1]
+		}
+		return p
+	}
+
+	_, err = Load(path)
+	var problems []Problem
+	for _, err := range flatten(err) {
+		var de *toml.DecodeError
+		var fe *FieldError
+		switch {
+		case errors.As(err, &de):
+			row, _ := de.Position()
+			problems = append(problems, at(row, de))
+		case errors.As(err, &fe):
+			problems = append(problems, at(locate(lines, fe.Field), err))
+		default:
+			problems = append(problems, at(0, err))
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems, nil
+}
+
+// flatten splits errors.Join results into their parts.
+func flatten(err error) []error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var out []error
+	for _, err := range joined.Unwrap() {
+		out = append(out, flatten(err)...)
+	}
+	return out
+}
+
+var (
+	tableLine = regexp.MustCompile(`^\s*(\[\[?)\s*([A-Za-z0-9_.-]+)\s*\]\]?`)
+	keyLine   = regexp.MustCompile(`^\s*([A-Za-z0-9_.-]+)\s*=`)
+	indexed   = regexp.MustCompile(`^(.*)\[(\d+)\]$`)
+)
+
+// locate returns the line of lines setting field, a FieldError path such as
+// "tunnel[1].ports[2]". A field the file does not set, e.g. a missing or
+// inherited key, is placed at the header of its table; 0 means not found.
+func locate(lines []string, field string) int {
+	// element of a list value
+	elem := -1
+	if m := indexed.FindStringSubmatch(field); m != nil && strings.Contains(m[1], ".") {
+		field = m[1]
+		elem, _ = strconv.Atoi(m[2])
+	}
+
+	headers := make(map[string]int)
+	keys := make(map[string]int)
+	counts := make(map[string]int)
+	table := ""
+	for i, line := range lines {
+		if m := tableLine.FindStringSubmatch(line); m != nil {
+			name := strings.ToLower(m[2])
+			if m[1] == "[[" {
+				table = fmt.Sprintf("%s[%d]", name, counts[name])
+				counts[name]++
+			} else {
+				// [tunnel.kdf] belongs to the latest [[tunnel]]
+				first, rest, _ := strings.Cut(name, ".")
+				if n := counts[first]; n > 0 {
+					first = fmt.Sprintf("%s[%d]", first, n-1)
+				}
+				table = strings.TrimSuffix(first+"."+rest, ".")
+			}
+			headers[table] = i + 1
+			continue
+		}
+		if m := keyLine.FindStringSubmatch(line); m != nil {
+			keys[table+"."+strings.ToLower(m[1])] = i + 1
+		}
+	}
+
+	if line, ok := keys[field]; ok {
+		if elem >= 0 {
+			return element(lines, line, elem)
+		}
+		return line
+	}
+	for f := field; f != ""; {
+		if line, ok := headers[f]; ok {
+			return line
+		}
+		if line, ok := keys[f]; ok {
+			return line
+		}
+		i := strings.LastIndex(f, ".")
+		if i < 0 {
+			break
+		}
+		f = f[:i]
+	}
+	return 0
+}
+
+// element returns the line holding the n-th string of the list value
+// starting on line, which may span several lines.
+func element(lines []string, line, n int) int {
+	for i := line - 1; i < len(lines); i++ {
+		s := lines[i]
+		if i == line-1 {
+			_, s, _ = strings.Cut(s, "=")
+		}
+		for {
+			q := strings.IndexAny(s, "\"'#]")
+			if q < 0 || s[q] == '#' {
+				break
+			}
+			if s[q] == ']' {
+				return line
+			}
+			end := strings.IndexByte(s[q+1:], s[q])
+			if n == 0 || end < 0 {
+				return i + 1
+			}
+			n--
+			s = s[q+end+2:]
+		}
+	}
+	return line
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	path := writeConfig(t, `[config]
+mode = "agent"
+bogus = 1
+key = "0123456789abcdeg"
+ports = [
+  "8088:8080",
+  "x",
+]
+
+[[tunnel]]
+name = "db"
+ports = ["5432:5432"]
+
+[tunnel.kdf]
+algorithm = "bcrypt"
+`)
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		line  int
+		field string
+	}{
+		{1, "config.server"},
+		{3, "config.bogus"},
+		{7, "config.ports[1]"},
+		{10, "tunnel[0].server"},
+		{14, "tunnel[0].kdf"},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for i, w := range want {
+		p := problems[i]
+		if p.Line != w.line || !strings.HasPrefix(p.Err.Error(), w.field+":") {
+			t.Errorf("problem %d = line %d %v, want line %d %s", i, p.Line, p.Err, w.line, w.field)
+		}
+	}
+	if problems[2].Text != `  "x",` {
+		t.Errorf("problem text = %q", problems[2].Text)
+	}
+}
+
+func TestCheckSyntaxError(t *testing.T) {
+	path := writeConfig(t, "[config]\nmode = \"agent\n")
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Line != 2 {
+		t.Fatalf("problems = %v", problems)
+	}
+}
+
+func TestStarter(t *testing.T) {
+	for _, mode := range []string{"agent", "server"} {
+		data, err := Starter(mode, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), mode+".toml")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", mode, err, data)
+		}
+		if tun := c.Tunnels()[0]; tun.Mode != mode {
+			t.Errorf("mode = %q, want %q", tun.Mode, mode)
+		}
+	}
+	a, _ := Starter("agent", "10.0.0.1")
+	b, _ := Starter("agent", "10.0.0.1")
+	if string(a) == string(b) {
+		t.Error("two starter configs share a key")
+	}
+	if _, err := Starter("relay", ""); err == nil {
+		t.Error("unknown mode: want error")
+	}
+}
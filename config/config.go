@@ -1,33 +1,369 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
+// defaultName names the tunnel described by the [config] table itself.
+const defaultName = "default"
+
+// Config is a configuration file. The [config] table describes a tunnel
+// of its own when it lists ports, and holds the defaults every [[tunnel]]
+// entry inherits for the keys it leaves unset, ports aside.
 type Config struct {
-	Config struct {
-		Mode  string
-		Key   string
-		Type  string
-		Ports []string
+	Config Tunnel
+	Tunnel []Tunnel
+
+	tunnels []*Tunnel
+}
+
+// Tunnel is one tunnel profile.
+type Tunnel struct {
+	Name      string
+	Mode      string
+	Transport string
+	Server    string
+	Listen    string
+	KeySource `mapstructure:",squash"`
+	Type      string
+	Ports     []string
+
+	// field is the table the tunnel came from, for error messages
+	field   string
+	sources map[string]string
+	secret  []byte
+}
+
+// FieldError reports an invalid value of a single configuration key.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// Load reads and validates the configuration file at path. A validation
+// failure is returned as the errors.Join of every problem found.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		return nil, errors.New("config path is empty")
 	}
+	return LoadLayered(path, nil)
 }
 
+// LoadConfig loads the file named by CONFIG_PATH and exits the process if
+// it is missing or invalid.
 func LoadConfig() (config *Config) {
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
 		log.Fatal("CONFIG_PATH is not set")
 	}
-	viper.SetConfigFile(configPath)
-	if err := viper.ReadInConfig(); err != nil {
-		panic(err)
-	}
-	if err := viper.Unmarshal(&config); err != nil {
-		panic("ERROR load config file!")
+	config, err := Load(configPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 	log.Println("================ Loaded Configuration ================")
 	return
 }
+
+// Tunnels returns the tunnels the file describes, with the defaults from
+// the [config] table applied to every [[tunnel]] entry.
+func (c *Config) Tunnels() []*Tunnel {
+	if c.tunnels != nil {
+		return c.tunnels
+	}
+	if len(c.Config.Ports) > 0 || len(c.Tunnel) == 0 {
+		t := c.Config.clone()
+		if t.Name == "" {
+			t.Name = defaultName
+		}
+		t.field = "config"
+		t.applyDefaults()
+		c.tunnels = append(c.tunnels, t)
+	}
+	for i := range c.Tunnel {
+		t := c.Tunnel[i].clone()
+		t.inherit(&c.Config)
+		t.field = fmt.Sprintf("tunnel[%d]", i)
+		t.applyDefaults()
+		c.tunnels = append(c.tunnels, t)
+	}
+	return c.tunnels
+}
+
+// Validate checks every tunnel and returns the errors.Join of a
+// *FieldError per problem, or nil.
+func (c *Config) Validate() error {
+	var errs []error
+	names := make(map[string]string)
+	serverKeys := make(map[string]string)
+	listens := make(map[string]string)
+	// the agent bind addresses taken on every type and local port, by the
+	// index of the tunnel taking them
+	locals := make(map[string][]boundAt)
+	for i, t := range c.Tunnels() {
+		if t.Name == "" {
+			errs = append(errs, &FieldError{Field: t.field + ".name", Err: errors.New("required")})
+		} else if other, ok := names[t.Name]; ok {
+			errs = append(errs, &FieldError{Field: t.field + ".name", Err: fmt.Errorf("%q already used by %s", t.Name, other)})
+		}
+		names[t.Name] = t.field
+
+		terrs := t.validate()
+		errs = append(errs, terrs...)
+		carriers := t.carriers()
+		if len(terrs) == 0 && t.Mode == "server" && slices.Contains(carriers, "icmp") {
+			// every ICMP server sees every echo request and keeps the ones
+			// its key opens
+			if other, ok := serverKeys[string(t.secret)]; ok {
+				errs = append(errs, &FieldError{Field: t.field + ".key", Err: fmt.Errorf("same key as tunnel %q; icmp servers tell tunnels apart by key", other)})
+			}
+			serverKeys[string(t.secret)] = t.Name
+		}
+		if t.Mode == "server" {
+			for _, addr := range t.udpListens() {
+				if other, ok := listens["udp "+addr]; ok {
+					errs = append(errs, &FieldError{Field: t.field + ".listen", Err: fmt.Errorf("%q already used by tunnel %q", addr, other)})
+				}
+				listens["udp "+addr] = t.Name
+			}
+			for _, addr := range t.tcpListens() {
+				if other, ok := listens["tcp "+addr]; ok {
+					errs = append(errs, &FieldError{Field: t.field + ".listen", Err: fmt.Errorf("TCP %q already used by tunnel %q", addr, other)})
+				}
+				listens["tcp "+addr] = t.Name
+			}
+		}
+		if t.Mode == "agent" {
+			errs = append(errs, c.localClashes(t, i, locals)...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// localClashes reports the entries of t's ports that listen where an agent
+// tunnel before it already does, then adds t's listeners to locals.
+func (c *Config) localClashes(t *Tunnel, index int, locals map[string][]boundAt) []error {
+	var errs []error
+	var taken []boundAt
+	var keys []string
+	for i, entry := range t.Ports {
+		ms, err := ParsePortMapping(entry)
+		if err != nil {
+			continue
+		}
+		for _, m := range ms {
+			key := fmt.Sprintf("%s %d", t.Type, m.LocalPort)
+			ip := net.ParseIP(m.BindAddr)
+			if j, ok := clash(locals[key], ip); ok {
+				errs = append(errs, &FieldError{Field: fmt.Sprintf("%s.ports[%d]", t.field, i), Err: fmt.Errorf("local %s already mapped by tunnel %q", m.Local(), c.tunnels[j].Name)})
+				break
+			}
+			taken = append(taken, boundAt{ip, index})
+			keys = append(keys, key)
+		}
+	}
+	for i, b := range taken {
+		locals[keys[i]] = append(locals[keys[i]], b)
+	}
+	return errs
+}
+
+func (t *Tunnel) validate() []error {
+	var errs []error
+	prefix := t.field
+	if prefix == "" {
+		prefix = "config"
+	}
+	field := func(name string, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: prefix + "." + name, Err: fmt.Errorf(format, args...)})
+	}
+
+	switch t.Mode {
+	case "agent":
+		if t.Server == "" {
+			field("server", "required in agent mode")
+		}
+	case "server":
+	case "":
+		field("mode", "required (\"agent\" or \"server\")")
+	default:
+		field("mode", "unknown mode %q (want \"agent\" or \"server\")", t.Mode)
+	}
+
+	if len(t.TransportList()) == 0 {
+		field("transport", "required")
+	}
+	carriers := t.carriers()
+	for i, c := range carriers {
+		if !slices.Contains(Transports, c) {
+			field("transport", "unknown transport %q (want one of %q, or several joined with \"+\" to bond them)", c, Transports)
+		} else if slices.Index(carriers, c) != i {
+			field("transport", "%q listed twice", c)
+		}
+	}
+	if t.Mode == "server" {
+		if slices.Contains(carriers, "udp") && t.Listen == "" {
+			field("listen", "required for the udp transport")
+		}
+		if addrs := t.udpListens(); len(slices.Compact(slices.Sorted(slices.Values(addrs)))) < len(addrs) {
+			field("transport", "two transports would share the UDP address %q", t.Listen)
+		}
+		if addrs := t.tcpListens(); len(addrs) > 1 && addrs[0] == addrs[1] {
+			field("transport", "faketcp-raw and http would share the TCP port of %q", addrs[0])
+		}
+	}
+
+	switch t.Type {
+	case "tcp", "udp":
+	default:
+		field("type", "unknown type %q (want \"tcp\" or \"udp\")", t.Type)
+	}
+
+	if _, err := t.Secret(); err != nil {
+		var fe *FieldError
+		if errors.As(err, &fe) {
+			fe.Field = prefix + "." + fe.Field
+		}
+		errs = append(errs, err)
+	}
+
+	if len(t.Ports) == 0 {
+		field("ports", "at least one port mapping is required")
+	}
+	for _, err := range portErrors(t.Ports) {
+		var me *MappingError
+		if errors.As(err, &me) {
+			err = &FieldError{Field: fmt.Sprintf("%s.ports[%d]", prefix, me.Index), Err: fmt.Errorf("%q: %w", me.Entry, me.Err)}
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Transports lists the carriers a tunnel can use; transport.Register adds
+// to it.
+var Transports = []string{"icmp", "faketcp", "udp"}
+
+// TransportList returns the transports of t in priority order: an agent
+// uses the first one that works, a server listens on all of them. An entry
+// joining names with "+", such as "icmp+faketcp", bonds those transports
+// into one that stripes traffic over all of them at once.
+func (t *Tunnel) TransportList() []string {
+	var out []string
+	for _, name := range strings.Split(t.Transport, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// udpListens returns the UDP addresses a server of t binds: faketcp, udp
+// and dns each bind one, faketcp and dns with a default port.
+func (t *Tunnel) udpListens() []string {
+	var out []string
+	for _, c := range t.carriers() {
+		switch c {
+		case "faketcp":
+			out = append(out, withPort(t.Listen, "4000"))
+		case "udp":
+			if t.Listen != "" {
+				out = append(out, t.Listen)
+			}
+		case "dns":
+			out = append(out, withPort(t.Listen, "53"))
+		}
+	}
+	return out
+}
+
+// tcpListens returns the TCP addresses a server of t takes: http listens
+// on one, port 80 by default, and faketcp-raw answers on one, port 4000 by
+// default.
+func (t *Tunnel) tcpListens() []string {
+	var out []string
+	for _, c := range t.carriers() {
+		switch c {
+		case "faketcp-raw":
+			out = append(out, withPort(t.Listen, "4000"))
+		case "http":
+			out = append(out, withPort(t.Listen, "80"))
+		}
+	}
+	return out
+}
+
+// withPort adds port to addr unless it has one already.
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// carriers returns every transport t names, bonded or not.
+func (t *Tunnel) carriers() []string {
+	var out []string
+	for _, entry := range t.TransportList() {
+		for _, name := range strings.Split(entry, "+") {
+			out = append(out, strings.TrimSpace(name))
+		}
+	}
+	return out
+}
+
+// NeedsRestart reports whether moving t to the settings of next takes
+// restarting the tunnel, rather than a Reload, which only applies the type
+// and ports.
+func (t *Tunnel) NeedsRestart(next *Tunnel) bool {
+	if t.Mode != next.Mode || t.Server != next.Server || t.Listen != next.Listen ||
+		t.KeySource != next.KeySource || !slices.Equal(t.TransportList(), next.TransportList()) {
+		return true
+	}
+	// the same source may hold another key by now
+	a, errA := t.Secret()
+	b, errB := next.Secret()
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+// Secret returns the tunnel key, resolving it from its source on first use.
+func (t *Tunnel) Secret() ([]byte, error) {
+	if t.secret == nil {
+		key, err := t.ResolveKey()
+		if err != nil {
+			return nil, err
+		}
+		t.secret = key
+	}
+	return t.secret, nil
+}
+
+// Watch calls onChange with the result of reloading path, with overrides
+// applied on top, every time the file changes on disk.
+func Watch(path string, overrides []Override, onChange func(*Config, error)) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("read config %s: %w", path, err)
+	}
+	v.OnConfigChange(func(fsnotify.Event) {
+		onChange(LoadLayered(path, overrides))
+	})
+	v.WatchConfig()
+	return nil
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+[config]
+mode = "agent"
+server = "10.0.0.1"
+key = "0123456789abcdef0123456789abcdef"
+ports = ["8088:8080"]
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tun := cfg.Tunnels()
+	if len(tun) != 1 || tun[0].Name != "default" || tun[0].Mode != "agent" || tun[0].Server != "10.0.0.1" || tun[0].Type != "tcp" || tun[0].Transport != "icmp" {
+		t.Fatalf("unexpected tunnels %+v", tun)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, `
+[config]
+mode = "relay"
+type = "sctp"
+key = "short"
+ports = ["8088:8080", "bad"]
+`)
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"config.mode", "config.type", "config.key", "config.ports[1]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		t.Errorf("expected a *FieldError in %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load(""); err == nil {
+		t.Error("expected error for empty path")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if _, err := Load(writeConfig(t, "[config]\nmode = \"server\"\nkey = \"0123456789abcdeF\"\nports = [\"1:2\"]\nprots = []\n")); err == nil {
+		t.Error("expected error for unknown key")
+	}
+}
+
+func TestLoadKeyFromEnv(t *testing.T) {
+	t.Setenv("TEST_TUNNEL_KEY", "hex:000102030405060708090a0b0c0d0e0f")
+	cfg, err := Load(writeConfig(t, `
+[config]
+mode = "server"
+key_env = "TEST_TUNNEL_KEY"
+ports = ["8088:8080"]
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	key, err := cfg.Tunnels()[0].Secret()
+	if err != nil || len(key) != 16 || key[15] != 0x0f {
+		t.Fatalf("Secret = %x, %v", key, err)
+	}
+}
+
+func TestLoadTunnelProfiles(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[config]
+mode = "agent"
+key = "0123456789ABCDEF"
+
+[[tunnel]]
+name = "db"
+server = "10.0.0.1"
+ports = ["5432:5432"]
+
+[[tunnel]]
+name = "dns"
+server = "10.0.0.2"
+type = "udp"
+key = "fedcba9876543210"
+ports = ["5353:53"]
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tun := cfg.Tunnels()
+	if len(tun) != 2 {
+		t.Fatalf("got %d tunnels", len(tun))
+	}
+	db, dns := tun[0], tun[1]
+	if db.Name != "db" || db.Mode != "agent" || db.Type != "tcp" || db.Key != "0123456789ABCDEF" {
+		t.Fatalf("db did not inherit defaults: %+v", db)
+	}
+	if dns.Name != "dns" || dns.Server != "10.0.0.2" || dns.Type != "udp" || dns.Key != "fedcba9876543210" {
+		t.Fatalf("dns overrides lost: %+v", dns)
+	}
+}
+
+func TestValidateTunnelProfiles(t *testing.T) {
+	_, err := Load(writeConfig(t, `
+[config]
+mode = "server"
+key = "0123456789ABCDEF"
+
+[[tunnel]]
+name = "a"
+ports = ["1:1"]
+
+[[tunnel]]
+name = "a"
+ports = ["2:2"]
+
+[[tunnel]]
+ports = ["3:3"]
+`))
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"tunnel[1].name", "tunnel[2].name", "tunnel[1].key"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestTunnelsKeepOwnPorts(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[config]
+mode = "agent"
+server = "10.0.0.1"
+key = "0123456789ABCDEF"
+ports = ["8088:8080"]
+
+[[tunnel]]
+name = "dns"
+type = "udp"
+ports = ["5353:53"]
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if dns := cfg.Tunnels()[1]; strings.Join(dns.Ports, ",") != "5353:53" {
+		t.Fatalf("dns ports = %q", dns.Ports)
+	}
+
+	_, err = Load(writeConfig(t, `
+[config]
+mode = "agent"
+server = "10.0.0.1"
+key = "0123456789ABCDEF"
+
+[[tunnel]]
+name = "web"
+ports = ["127.0.0.1:8088:8080", "9000:9000"]
+
+[[tunnel]]
+name = "admin"
+ports = ["9001:9001", "8088:8081"]
+
+[[tunnel]]
+name = "dns"
+type = "udp"
+ports = ["8088:53"]
+`))
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	if want := `tunnel[1].ports[1]: local :8088 already mapped by tunnel "web"`; !strings.Contains(err.Error(), want) {
+		t.Errorf("error does not mention %s:\n%v", want, err)
+	}
+	if strings.Contains(err.Error(), "tunnel[2]") {
+		t.Errorf("udp tunnel reported:\n%v", err)
+	}
+}
+
+func TestTransportList(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[config]
+mode = "agent"
+server = "10.0.0.1"
+transport = "faketcp, icmp"
+key = "0123456789ABCDEF"
+ports = ["1:1"]
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Tunnels()[0].TransportList(); strings.Join(got, " ") != "faketcp icmp" {
+		t.Fatalf("TransportList = %q", got)
+	}
+
+	_, err = Load(writeConfig(t, `
+[config]
+mode = "server"
+transport = "icmp+faketcp,carrier-pigeon,icmp"
+key = "0123456789ABCDEF"
+ports = ["1:1"]
+`))
+	for _, want := range []string{`unknown transport "carrier-pigeon"`, `"icmp" listed twice`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestTransportsSharingPorts(t *testing.T) {
+	// the transport package registers these
+	defer func(old []string) { Transports = old }(Transports)
+	Transports = append(slices.Clone(Transports), "faketcp-raw", "http")
+
+	_, err := Load(writeConfig(t, `
+[config]
+mode = "server"
+transport = "faketcp-raw,http"
+listen = ":8000"
+key = "0123456789ABCDEF"
+ports = ["1:1"]
+`))
+	if err == nil || !strings.Contains(err.Error(), `share the TCP port of ":8000"`) {
+		t.Fatalf("err = %v", err)
+	}
+	if _, err := Load(writeConfig(t, `
+[config]
+mode = "server"
+transport = "faketcp-raw,http"
+key = "0123456789ABCDEF"
+ports = ["1:1"]
+`)); err != nil {
+		t.Fatalf("default ports: %v", err)
+	}
+}
+
+func TestNeedsRestart(t *testing.T) {
+	base := Tunnel{Mode: "agent", Transport: "icmp, faketcp", Server: "10.0.0.1", KeySource: KeySource{Key: "0123456789ABCDEF"}, Type: "tcp", Ports: []string{"1:1"}}
+	for _, tt := range []struct {
+		name    string
+		change  func(*Tunnel)
+		restart bool
+	}{
+		{"ports", func(t *Tunnel) { t.Ports = []string{"2:2"} }, false},
+		{"type", func(t *Tunnel) { t.Type = "udp" }, false},
+		{"transport spacing", func(t *Tunnel) { t.Transport = "icmp,faketcp" }, false},
+		{"transport order", func(t *Tunnel) { t.Transport = "faketcp,icmp" }, true},
+		{"server", func(t *Tunnel) { t.Server = "10.0.0.2" }, true},
+		{"listen", func(t *Tunnel) { t.Listen = ":5000" }, true},
+		{"mode", func(t *Tunnel) { t.Mode = "server" }, true},
+		{"key", func(t *Tunnel) { t.Key = "FEDCBA9876543210" }, true},
+		{"kdf", func(t *Tunnel) { t.KDF.Algorithm = "scrypt" }, true},
+	} {
+		cur, next := base, base
+		tt.change(&next)
+		if got := cur.NeedsRestart(&next); got != tt.restart {
+			t.Errorf("%s: NeedsRestart = %v", tt.name, got)
+		}
+	}
+
+	// a key file rewritten in place
+	file := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(file, []byte("0123456789ABCDEF"), 0o600)
+	cur := Tunnel{Mode: "agent", KeySource: KeySource{KeyFile: file}}
+	cur.Secret()
+	os.WriteFile(file, []byte("FEDCBA9876543210"), 0o600)
+	next := cur
+	next.secret = nil
+	if !cur.NeedsRestart(&next) {
+		t.Error("key file contents: no restart")
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// defaultSalt is used when kdf.salt is unset. Deployments should set their
+// own so one passphrase does not yield the same key everywhere.
+const defaultSalt = "icmp-tunnel/kdf"
+
+// derivedKeyLen is the length of a derived key, selecting AES-256.
+const derivedKeyLen = 32
+
+// KDF stretches a passphrase into the tunnel key. Both ends of a tunnel
+// must use the same algorithm, salt and parameters.
+type KDF struct {
+	// Algorithm is "scrypt" or "argon2id"; empty uses the key as is.
+	Algorithm string
+	// Salt is decoded like the key ("hex:" and "base64:" prefixes).
+	Salt string
+
+	// scrypt cost parameters
+	N int
+	R int
+	P int
+
+	// argon2id parameters; Memory is in KiB
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Derive stretches passphrase according to k.
+func (k KDF) Derive(passphrase []byte) ([]byte, error) {
+	salt, err := decodeKey(k.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("salt: %w", err)
+	}
+	if len(salt) == 0 {
+		salt = []byte(defaultSalt)
+	}
+
+	switch k.Algorithm {
+	case "scrypt":
+		n, r, p := k.N, k.R, k.P
+		if n == 0 {
+			n = 1 << 15
+		}
+		if r == 0 {
+			r = 8
+		}
+		if p == 0 {
+			p = 1
+		}
+		return scrypt.Key(passphrase, salt, n, r, p, derivedKeyLen)
+	case "argon2id":
+		t, m, threads := k.Time, k.Memory, k.Threads
+		if t == 0 {
+			t = 3
+		}
+		if m == 0 {
+			m = 64 * 1024
+		}
+		if threads == 0 {
+			threads = 4
+		}
+		if m < 8*uint32(threads) {
+			return nil, fmt.Errorf("memory must be at least %d KiB for %d threads", 8*uint32(threads), threads)
+		}
+		return argon2.IDKey(passphrase, salt, t, m, threads, derivedKeyLen), nil
+	case "":
+		return nil, errors.New("no algorithm set")
+	}
+	return nil, fmt.Errorf("unknown algorithm %q (want \"scrypt\" or \"argon2id\")", k.Algorithm)
+}
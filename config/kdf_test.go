@@ -0,0 +1,75 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKDFDerive(t *testing.T) {
+	pass := []byte("correct horse battery staple")
+	for _, k := range []KDF{
+		{Algorithm: "scrypt", N: 1024},
+		{Algorithm: "argon2id", Time: 1, Memory: 64, Threads: 1},
+	} {
+		a, err := k.Derive(pass)
+		if err != nil {
+			t.Fatalf("%s: %v", k.Algorithm, err)
+		}
+		if len(a) != 32 {
+			t.Fatalf("%s: got %d bytes", k.Algorithm, len(a))
+		}
+		b, _ := k.Derive(pass)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s: derivation is not deterministic", k.Algorithm)
+		}
+		k.Salt = "hex:00112233"
+		c, err := k.Derive(pass)
+		if err != nil {
+			t.Fatalf("%s: %v", k.Algorithm, err)
+		}
+		if bytes.Equal(a, c) {
+			t.Fatalf("%s: salt does not change the key", k.Algorithm)
+		}
+	}
+}
+
+func TestResolveKeyWithKDF(t *testing.T) {
+	ks := KeySource{Key: "a human passphrase", KDF: KDF{Algorithm: "scrypt", N: 1024}}
+	key, err := ks.ResolveKey()
+	if err != nil {
+		t.Fatalf("ResolveKey: %v", err)
+	}
+	want, _ := ks.KDF.Derive([]byte("a human passphrase"))
+	if !bytes.Equal(key, want) {
+		t.Fatal("ResolveKey did not use the KDF")
+	}
+
+	ks.KDF.Algorithm = "md5"
+	if _, err := ks.ResolveKey(); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func TestLoadKDF(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[config]
+mode = "server"
+key = "a human passphrase"
+ports = ["8088:8080"]
+
+[config.kdf]
+algorithm = "argon2id"
+salt = "base64:c2FsdHNhbHQ="
+time = 1
+memory = 64
+threads = 1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	key, _ := cfg.Tunnels()[0].Secret()
+	want, _ := KDF{Algorithm: "argon2id", Salt: "base64:c2FsdHNhbHQ=", Time: 1, Memory: 64, Threads: 1}.Derive([]byte("a human passphrase"))
+	if !bytes.Equal(key, want) {
+		t.Fatal("Load did not derive the key from the passphrase")
+	}
+}
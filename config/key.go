@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKeys are the placeholder secrets earlier builds shipped with.
+var defaultKeys = []string{"0123456789abcdef", "supersecretkey123"}
+
+// KeySource says where the tunnel key comes from. Exactly one of the key
+// fields must be set. Values are taken verbatim unless prefixed with "hex:"
+// or "base64:". With a KDF configured the value is a passphrase instead.
+type KeySource struct {
+	// Key is the key itself.
+	Key string
+	// KeyFile names a file holding the key.
+	KeyFile string `mapstructure:"key_file"`
+	// KeyEnv names an environment variable holding the key.
+	KeyEnv string `mapstructure:"key_env"`
+	// KeyCommand is a command printing the key on stdout, run with sh -c.
+	// It runs once per process; reloads reuse its output until the
+	// command itself changes.
+	KeyCommand string `mapstructure:"key_command"`
+	// KDF optionally derives the key from a passphrase.
+	KDF KDF
+}
+
+// ResolveKey fetches and decodes the key, refusing the built-in defaults,
+// and runs it through the KDF if one is configured.
+// Errors are *FieldErrors naming the source that failed.
+func (k KeySource) ResolveKey() ([]byte, error) {
+	var field, raw string
+	set := 0
+	if k.Key != "" {
+		field, raw = "key", k.Key
+		set++
+	}
+	if k.KeyFile != "" {
+		field = "key_file"
+		set++
+	}
+	if k.KeyEnv != "" {
+		field = "key_env"
+		set++
+	}
+	if k.KeyCommand != "" {
+		field = "key_command"
+		set++
+	}
+	switch set {
+	case 0:
+		return nil, &FieldError{Field: "key", Err: errors.New("required: set one of key, key_file, key_env or key_command")}
+	case 1:
+	default:
+		return nil, &FieldError{Field: "key", Err: errors.New("only one of key, key_file, key_env or key_command may be set")}
+	}
+
+	switch field {
+	case "key_file":
+		b, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, &FieldError{Field: field, Err: err}
+		}
+		raw = strings.TrimSpace(string(b))
+	case "key_env":
+		v, ok := os.LookupEnv(k.KeyEnv)
+		if !ok {
+			return nil, &FieldError{Field: field, Err: fmt.Errorf("$%s is not set", k.KeyEnv)}
+		}
+		raw = strings.TrimSpace(v)
+	case "key_command":
+		out, err := runKeyCommand(k.KeyCommand)
+		if err != nil {
+			return nil, &FieldError{Field: field, Err: err}
+		}
+		raw = out
+	}
+
+	key, err := decodeKey(raw)
+	if err != nil {
+		return nil, &FieldError{Field: field, Err: err}
+	}
+	for _, d := range defaultKeys {
+		if string(key) == d {
+			return nil, &FieldError{Field: field, Err: errors.New("refusing the built-in default key; generate a random one")}
+		}
+	}
+	if k.KDF.Algorithm != "" {
+		if len(key) == 0 {
+			return nil, &FieldError{Field: field, Err: errors.New("passphrase is empty")}
+		}
+		key, err = k.KDF.Derive(key)
+		if err != nil {
+			return nil, &FieldError{Field: "kdf", Err: err}
+		}
+		return key, nil
+	}
+	if len(key) != 16 && len(key) != 32 {
+		return nil, &FieldError{Field: field, Err: fmt.Errorf("must be 16 bytes (AES-128) or 32 bytes (AES-256), got %d", len(key))}
+	}
+	return key, nil
+}
+
+// keyCommands holds the output of every key command run so far, so that
+// loading the config again doesn't run them again.
+var keyCommands struct {
+	sync.Mutex
+	out map[string]string
+}
+
+// runKeyCommand runs command through the shell, or returns what it printed
+// the first time. Failures are tried again next time.
+func runKeyCommand(command string) (string, error) {
+	keyCommands.Lock()
+	defer keyCommands.Unlock()
+	if out, ok := keyCommands.out[command]; ok {
+		return out, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+	if err != nil {
+		return "", err
+	}
+	if keyCommands.out == nil {
+		keyCommands.out = make(map[string]string)
+	}
+	out := strings.TrimSpace(string(b))
+	keyCommands.out[command] = out
+	return out, nil
+}
+
+// decodeKey strips an optional "hex:" or "base64:" prefix.
+func decodeKey(s string) ([]byte, error) {
+	if v, ok := strings.CutPrefix(s, "hex:"); ok {
+		return hex.DecodeString(v)
+	}
+	if v, ok := strings.CutPrefix(s, "base64:"); ok {
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return b, nil
+		}
+		return base64.RawStdEncoding.DecodeString(v)
+	}
+	return []byte(s), nil
+}
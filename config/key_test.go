@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveKey(t *testing.T) {
+	want := []byte("0123456789ABCDEF")
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte("hex:30313233343536373839414243444546\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_TUNNEL_KEY", "base64:MDEyMzQ1Njc4OUFCQ0RFRg==")
+
+	for _, ks := range []KeySource{
+		{Key: "0123456789ABCDEF"},
+		{Key: "hex:30313233343536373839414243444546"},
+		{Key: "base64:MDEyMzQ1Njc4OUFCQ0RFRg"},
+		{KeyFile: file},
+		{KeyEnv: "TEST_TUNNEL_KEY"},
+		{KeyCommand: "echo 0123456789ABCDEF"},
+	} {
+		got, err := ks.ResolveKey()
+		if err != nil {
+			t.Fatalf("%+v: %v", ks, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%+v: got %q want %q", ks, got, want)
+		}
+	}
+}
+
+func TestResolveKeyErrors(t *testing.T) {
+	tests := []struct {
+		ks    KeySource
+		field string
+	}{
+		{KeySource{}, "key"},
+		{KeySource{Key: "0123456789ABCDEF", KeyEnv: "X"}, "key"},
+		{KeySource{Key: "0123456789abcdef"}, "key"},
+		{KeySource{Key: "supersecretkey123"}, "key"},
+		{KeySource{Key: "too short"}, "key"},
+		{KeySource{Key: "hex:zz"}, "key"},
+		{KeySource{KeyFile: filepath.Join(t.TempDir(), "missing")}, "key_file"},
+		{KeySource{KeyEnv: "TEST_TUNNEL_KEY_UNSET"}, "key_env"},
+		{KeySource{KeyCommand: "exit 1"}, "key_command"},
+	}
+	for _, tt := range tests {
+		_, err := tt.ks.ResolveKey()
+		var fe *FieldError
+		if !errors.As(err, &fe) || fe.Field != tt.field {
+			t.Errorf("%+v: expected error on %s, got %v", tt.ks, tt.field, err)
+		}
+	}
+}
+
+func TestKeyCommandRunsOnce(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	ks := KeySource{KeyCommand: "echo run >> " + count + "; echo 0123456789ABCDEF"}
+	for range 3 {
+		if _, err := ks.ResolveKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := bytes.Count(b, []byte("run")); runs != 1 {
+		t.Fatalf("key_command ran %d times", runs)
+	}
+}
@@ -0,0 +1,265 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix starts every environment variable the configuration reads.
+const EnvPrefix = "TUNNEL_"
+
+// LoadLayered builds the configuration from, in increasing precedence, the
+// defaults, the file at path (skipped when path is empty) and overrides,
+// then validates it like Load.
+//
+// Overrides of the [config] table reach every [[tunnel]] entry that does
+// not set the option itself; override a single entry by naming it.
+func LoadLayered(path string, overrides []Override) (*Config, error) {
+	var config Config
+	var errs []error
+	if path != "" {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("read config %s: %w", path, err)
+		}
+		// unknown keys are reported along with the validation errors
+		var md mapstructure.Metadata
+		if err := v.Unmarshal(&config, func(dc *mapstructure.DecoderConfig) { dc.Metadata = &md }); err != nil {
+			return nil, fmt.Errorf("decode config %s: %w", path, err)
+		}
+		for _, key := range md.Unused {
+			errs = append(errs, &FieldError{Field: unusedField(key), Err: errors.New("unknown key")})
+		}
+	}
+	config.Config.markFile()
+	for i := range config.Tunnel {
+		config.Tunnel[i].markFile()
+	}
+
+	// a variable the file names in key_env holds a key, not an override,
+	// though it may look like one (TUNNEL_KEY)
+	keyEnvs := map[string]bool{config.Config.KeyEnv: true}
+	for _, t := range config.Tunnel {
+		keyEnvs[t.KeyEnv] = true
+	}
+	for _, o := range overrides {
+		if name, ok := strings.CutPrefix(o.Source, "env "); ok && keyEnvs[name] {
+			continue
+		}
+		t := &config.Config
+		if o.Tunnel != "" {
+			t = nil
+			for i := range config.Tunnel {
+				if envName(config.Tunnel[i].Name) == envName(o.Tunnel) {
+					t = &config.Tunnel[i]
+				}
+			}
+			if t == nil {
+				errs = append(errs, fmt.Errorf("%s: no [[tunnel]] named %q", o.Source, o.Tunnel))
+				continue
+			}
+		}
+		if err := t.apply(o); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &config, nil
+}
+
+// unusedField turns a key reported by mapstructure, e.g. "Tunnel[0].sever",
+// into the form FieldError uses.
+func unusedField(key string) string {
+	table, rest, _ := strings.Cut(key, ".")
+	table = strings.ToLower(table)
+	if rest == "" {
+		return table
+	}
+	return table + "." + rest
+}
+
+// envName turns an option or tunnel name into its environment form.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// EnvOverrides picks the options set in environ, a list of "NAME=value"
+// pairs: TUNNEL_<OPTION> for the [config] table and
+// TUNNEL_<TUNNEL>__<OPTION> for one [[tunnel]] entry, e.g. TUNNEL_SERVER or
+// TUNNEL_DB__KDF_SALT. Other TUNNEL_ variables are ignored.
+func EnvOverrides(environ []string) []Override {
+	byEnv := make(map[string]string, len(options))
+	for _, o := range options {
+		byEnv[envName(o.name)] = o.name
+	}
+	var out []Override
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		tunnel, opt, scoped := strings.Cut(rest, "__")
+		if !scoped {
+			tunnel, opt = "", rest
+		}
+		if o, ok := byEnv[opt]; ok {
+			out = append(out, Override{Tunnel: tunnel, Option: o, Value: value, Source: "env " + name})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
+
+func flagName(option string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(option)
+}
+
+// setFlag collects repeated -set [tunnel.]option=value flags, where the
+// tunnel "config" or none at all means the [config] table.
+type setFlag []Override
+
+func (s *setFlag) String() string { return "" }
+
+func (s *setFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return errors.New("want [tunnel.]option=value")
+	}
+	o := Override{Option: key, Value: value, Source: "flag -set " + key}
+	if _, ok := lookupOption(key); !ok {
+		tunnel, opt, scoped := strings.Cut(key, ".")
+		if _, ok := lookupOption(opt); !scoped || !ok {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if tunnel != "config" {
+			o.Tunnel = tunnel
+		}
+		o.Option = opt
+	}
+	*s = append(*s, o)
+	return nil
+}
+
+// RegisterFlags defines a flag per option on fs, setting the [config]
+// table, plus a repeatable -set [tunnel.]option=value. After fs is parsed
+// the returned function yields the overrides given on the command line.
+func RegisterFlags(fs *flag.FlagSet) func() []Override {
+	for _, o := range options {
+		fs.String(flagName(o.name), "", o.usage)
+	}
+	var sets setFlag
+	fs.Var(&sets, "set", "set an option as [tunnel.]option=value, \"config.\" or no prefix meaning the [config] table (repeatable)")
+	return func() []Override {
+		var out []Override
+		fs.Visit(func(f *flag.Flag) {
+			for _, o := range options {
+				if flagName(o.name) == f.Name {
+					out = append(out, Override{Option: o.name, Value: f.Value.String(), Source: "flag -" + f.Name})
+				}
+			}
+		})
+		return append(out, sets...)
+	}
+}
+
+// Print writes the effective value of every option of every tunnel and
+// the layer it came from. Key material is redacted.
+func (c *Config) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, t := range c.Tunnels() {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "# tunnel %q from %s\n", t.Name, t.field)
+		for _, o := range options {
+			v := o.get(t)
+			if v == "" {
+				continue
+			}
+			if o.name == "key" {
+				v = "<redacted>"
+			}
+			fmt.Fprintf(tw, "%s\t= %s\t# %s\n", o.name, strconv.Quote(v), t.Source(o.name))
+		}
+	}
+	return tw.Flush()
+}
+
+// ApplyEnv sets every flag of fs that has a TUNNEL_<FLAG> environment
+// variable, e.g. TUNNEL_KEY_FILE for -key-file. Call it before fs.Parse so
+// the command line still wins. It returns the variable used per flag.
+func ApplyEnv(fs *flag.FlagSet) (map[string]string, error) {
+	used := make(map[string]string)
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvPrefix + envName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			// set the value directly so fs.Visit still reports only the
+			// flags given on the command line
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+			used[f.Name] = name
+		}
+	})
+	return used, errors.Join(errs...)
+}
+
+// PrintFlags writes the effective value of every flag of the parsed fs and
+// whether it came from the default, the environment (see ApplyEnv) or the
+// command line. The -key value is redacted and shorthand flags, whose
+// usage starts with "shorthand for", are left out.
+func PrintFlags(w io.Writer, fs *flag.FlagSet, env map[string]string) error {
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		name := f.Name
+		if long, ok := strings.CutPrefix(f.Usage, "shorthand for -"); ok {
+			name = long
+		}
+		set[name] = "flag -" + f.Name
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" || strings.HasPrefix(f.Usage, "shorthand for ") {
+			return
+		}
+		source := "default"
+		if env[f.Name] != "" {
+			source = "env " + env[f.Name]
+		}
+		if set[f.Name] != "" {
+			source = set[f.Name]
+		}
+		v := f.Value.String()
+		if f.Name == "key" && v != "" {
+			v = "<redacted>"
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", f.Name, strconv.Quote(v), source)
+	})
+	return tw.Flush()
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadLayeredPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+[config]
+mode = "agent"
+server = "10.0.0.1"
+key = "0123456789abcdeg"
+ports = ["8088:8080"]
+
+[[tunnel]]
+name = "db-link"
+key_file = "/nonexistent"
+ports = ["5432:5432"]
+`)
+	env := EnvOverrides([]string{
+		"TUNNEL_SERVER=10.0.0.2",
+		"TUNNEL_TYPE=udp",
+		"TUNNEL_DB_LINK__KEY=fedcba9876543210",
+		"TUNNEL_CONFIG=ignored",
+		"PATH=/bin",
+	})
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-type", "tcp", "-set", "db-link.server=10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadLayered(path, append(env, flags()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := c.Tunnels()
+	def, db := ts[0], ts[1]
+	if def.Server != "10.0.0.2" || def.Source("server") != "env TUNNEL_SERVER" {
+		t.Errorf("default server = %q from %q", def.Server, def.Source("server"))
+	}
+	if def.Type != "tcp" || def.Source("type") != "flag -type" {
+		t.Errorf("default type = %q from %q", def.Type, def.Source("type"))
+	}
+	if def.Mode != "agent" || def.Source("mode") != "file" {
+		t.Errorf("default mode = %q from %q", def.Mode, def.Source("mode"))
+	}
+	if def.Transport != "icmp" || def.Source("transport") != "default" {
+		t.Errorf("default transport = %q from %q", def.Transport, def.Source("transport"))
+	}
+	if db.Server != "10.0.0.3" || db.Source("server") != "flag -set db-link.server" {
+		t.Errorf("db-link server = %q from %q", db.Server, db.Source("server"))
+	}
+	// the env key replaces the key_file from the file
+	if db.Key != "fedcba9876543210" || db.KeyFile != "" {
+		t.Errorf("db-link key = %q, key_file = %q", db.Key, db.KeyFile)
+	}
+
+	var out bytes.Buffer
+	if err := c.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "fedcba9876543210") {
+		t.Errorf("Print leaked the key:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "# env TUNNEL_SERVER") {
+		t.Errorf("Print is missing sources:\n%s", out.String())
+	}
+}
+
+func TestLoadLayeredWithoutFile(t *testing.T) {
+	c, err := LoadLayered("", EnvOverrides([]string{
+		"TUNNEL_MODE=server",
+		"TUNNEL_KEY=0123456789abcdeg",
+		"TUNNEL_PORTS=8080:80, 9000:90",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Tunnels()[0].Ports; len(got) != 2 || got[1] != "9000:90" {
+		t.Errorf("ports = %q", got)
+	}
+}
+
+func TestLoadLayeredKeyEnvIsNoOverride(t *testing.T) {
+	path := writeConfig(t, `
+[config]
+mode = "server"
+key_env = "TUNNEL_KEY"
+ports = ["8080:80"]
+`)
+	t.Setenv("TUNNEL_KEY", "0123456789abcdeg")
+	c, err := LoadLayered(path, EnvOverrides(os.Environ()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun := c.Tunnels()[0]; tun.KeyEnv != "TUNNEL_KEY" || tun.Key != "" || tun.Source("key_env") != "file" {
+		t.Errorf("key_env = %q (%s), key = %q", tun.KeyEnv, tun.Source("key_env"), tun.Key)
+	}
+}
+
+func TestLoadLayeredErrors(t *testing.T) {
+	path := writeConfig(t, `
+[config]
+mode = "server"
+key = "0123456789abcdeg"
+ports = ["8080:80"]
+`)
+	if _, err := LoadLayered(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []Override{
+		{Tunnel: "missing", Option: "mode", Value: "agent", Source: "test"},
+		{Option: "kdf.n", Value: "lots", Source: "test"},
+		{Option: "mode", Value: "relay", Source: "test"},
+	} {
+		if _, err := LoadLayered(path, []Override{o}); err == nil {
+			t.Errorf("%+v: want error", o)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	fs.SetOutput(&bytes.Buffer{})
+	if err := fs.Parse([]string{"-set", "nosuch=1"}); err == nil {
+		t.Error("-set with an unknown option: want error")
+	}
+}
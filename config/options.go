@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// option is one per-tunnel setting, addressable by name from the
+// environment and the command line.
+type option struct {
+	name  string
+	usage string
+	// group names options inherited and overridden as a unit
+	group string
+	// own options are not inherited from the [config] table
+	own bool
+	// def is the value used when no layer sets one
+	def string
+	get func(*Tunnel) string
+	set func(*Tunnel, string) error
+}
+
+var options = []option{
+	{name: "mode", usage: "role of the tunnel: \"agent\" or \"server\"",
+		get: func(t *Tunnel) string { return t.Mode }, set: func(t *Tunnel, v string) error { t.Mode = v; return nil }},
+	{name: "transport", usage: "carriers between agent and server in priority order, e.g. \"faketcp,icmp\"", def: "icmp",
+		get: func(t *Tunnel) string { return t.Transport }, set: func(t *Tunnel, v string) error { t.Transport = v; return nil }},
+	{name: "server", usage: "address of the tunnel server (agent mode)",
+		get: func(t *Tunnel) string { return t.Server }, set: func(t *Tunnel, v string) error { t.Server = v; return nil }},
+	{name: "listen", usage: "address the server listens on (faketcp, default \":4000\", and udp)",
+		get: func(t *Tunnel) string { return t.Listen }, set: func(t *Tunnel, v string) error { t.Listen = v; return nil }},
+	{name: "key", usage: "tunnel key or passphrase", group: "key",
+		get: func(t *Tunnel) string { return t.Key }, set: func(t *Tunnel, v string) error { t.Key = v; return nil }},
+	{name: "key_file", usage: "file holding the tunnel key", group: "key",
+		get: func(t *Tunnel) string { return t.KeyFile }, set: func(t *Tunnel, v string) error { t.KeyFile = v; return nil }},
+	{name: "key_env", usage: "environment variable holding the tunnel key", group: "key",
+		get: func(t *Tunnel) string { return t.KeyEnv }, set: func(t *Tunnel, v string) error { t.KeyEnv = v; return nil }},
+	{name: "key_command", usage: "command printing the tunnel key, run once with sh -c", group: "key",
+		get: func(t *Tunnel) string { return t.KeyCommand }, set: func(t *Tunnel, v string) error { t.KeyCommand = v; return nil }},
+	{name: "kdf.algorithm", usage: "derive the key from a passphrase: \"scrypt\" or \"argon2id\"", group: "kdf",
+		get: func(t *Tunnel) string { return t.KDF.Algorithm }, set: func(t *Tunnel, v string) error { t.KDF.Algorithm = v; return nil }},
+	{name: "kdf.salt", usage: "KDF salt", group: "kdf",
+		get: func(t *Tunnel) string { return t.KDF.Salt }, set: func(t *Tunnel, v string) error { t.KDF.Salt = v; return nil }},
+	numOption("kdf.n", "scrypt CPU/memory cost", func(t *Tunnel) *int { return &t.KDF.N }),
+	numOption("kdf.r", "scrypt block size", func(t *Tunnel) *int { return &t.KDF.R }),
+	numOption("kdf.p", "scrypt parallelism", func(t *Tunnel) *int { return &t.KDF.P }),
+	numOption("kdf.time", "argon2id passes", func(t *Tunnel) *uint32 { return &t.KDF.Time }),
+	numOption("kdf.memory", "argon2id memory in KiB", func(t *Tunnel) *uint32 { return &t.KDF.Memory }),
+	numOption("kdf.threads", "argon2id threads", func(t *Tunnel) *uint8 { return &t.KDF.Threads }),
+	{name: "type", usage: "forwarded protocol: \"tcp\" or \"udp\"", def: "tcp",
+		get: func(t *Tunnel) string { return t.Type }, set: func(t *Tunnel, v string) error { t.Type = v; return nil }},
+	{name: "ports", usage: "comma-separated port mappings", own: true,
+		get: func(t *Tunnel) string { return strings.Join(t.Ports, ",") },
+		set: func(t *Tunnel, v string) error {
+			t.Ports = nil
+			for _, p := range strings.Split(v, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					t.Ports = append(t.Ports, p)
+				}
+			}
+			return nil
+		}},
+}
+
+// numOption is an option backed by a numeric field where 0 means unset.
+func numOption[T int | uint8 | uint32](name, usage string, field func(*Tunnel) *T) option {
+	return option{name: name, usage: usage, group: "kdf",
+		get: func(t *Tunnel) string {
+			if v := *field(t); v != 0 {
+				return fmt.Sprint(v)
+			}
+			return ""
+		},
+		set: func(t *Tunnel, v string) error {
+			if v == "" {
+				*field(t) = 0
+				return nil
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || uint64(T(n)) != n {
+				return fmt.Errorf("%q is not a valid %s", v, name)
+			}
+			*field(t) = T(n)
+			return nil
+		}}
+}
+
+func lookupOption(name string) (option, bool) {
+	for _, o := range options {
+		if o.name == name {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// Override sets one option on top of the configuration file.
+type Override struct {
+	// Tunnel names the [[tunnel]] entry to change, empty for [config].
+	Tunnel string
+	Option string
+	Value  string
+	// Source describes where the value came from, e.g. "env TUNNEL_SERVER".
+	Source string
+}
+
+// apply sets o on t. Setting one option of the key source replaces the
+// whole source, so an override never clashes with the file's choice.
+func (t *Tunnel) apply(o Override) error {
+	opt, ok := lookupOption(o.Option)
+	if !ok {
+		return fmt.Errorf("%s: unknown option %q", o.Source, o.Option)
+	}
+	if opt.group == "key" {
+		for _, other := range options {
+			if other.group == "key" && other.name != opt.name {
+				_ = other.set(t, "")
+				delete(t.sources, other.name)
+			}
+		}
+	}
+	if err := opt.set(t, o.Value); err != nil {
+		return fmt.Errorf("%s: %s: %v", o.Source, o.Option, err)
+	}
+	t.setSource(opt.name, o.Source)
+	return nil
+}
+
+func (t *Tunnel) setSource(name, source string) {
+	if t.sources == nil {
+		t.sources = make(map[string]string)
+	}
+	t.sources[name] = source
+}
+
+// Source says which layer set the effective value of an option: "default",
+// "file", an environment variable or a flag, possibly via [config].
+func (t *Tunnel) Source(name string) string {
+	return t.sources[name]
+}
+
+// markFile records the options the configuration file set.
+func (t *Tunnel) markFile() {
+	for _, o := range options {
+		if o.get(t) != "" {
+			t.setSource(o.name, "file")
+		}
+	}
+}
+
+// inherit fills the options t leaves unset from d. Grouped options are
+// only taken from d when t sets none of the group, own options never.
+func (t *Tunnel) inherit(d *Tunnel) {
+	groupSet := make(map[string]bool)
+	for _, o := range options {
+		if o.group != "" && o.get(t) != "" {
+			groupSet[o.group] = true
+		}
+	}
+	for _, o := range options {
+		if o.own || o.get(t) != "" || groupSet[o.group] {
+			continue
+		}
+		if v := o.get(d); v != "" {
+			_ = o.set(t, v)
+			t.setSource(o.name, "[config] "+d.sources[o.name])
+		}
+	}
+}
+
+// clone returns a copy of t that can be changed without touching t.
+func (t Tunnel) clone() *Tunnel {
+	sources := make(map[string]string, len(t.sources))
+	for k, v := range t.sources {
+		sources[k] = v
+	}
+	t.sources = sources
+	return &t
+}
+
+// applyDefaults sets the default of every option no layer set.
+func (t *Tunnel) applyDefaults() {
+	for _, o := range options {
+		if o.def != "" && o.get(t) == "" {
+			_ = o.set(t, o.def)
+			t.setSource(o.name, "default")
+		}
+	}
+}
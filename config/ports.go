@@ -0,0 +1,258 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortMapping is one forward described by an entry of the ports list:
+//
+//	[bind:]local:[host:]remote
+//
+// Ports may be ranges ("7000-7010:9000-9010") of equal length, and IPv6
+// addresses are written in brackets ("[::1]:8088:[fd00::5]:5432").
+type PortMapping struct {
+	// BindAddr is the agent address to listen on, empty for all addresses.
+	BindAddr  string
+	LocalPort uint16
+	// RemoteHost is the host the server dials, empty for the server itself.
+	RemoteHost string
+	RemotePort uint16
+}
+
+// Local returns the address the agent listens on.
+func (m PortMapping) Local() string {
+	return net.JoinHostPort(m.BindAddr, strconv.Itoa(int(m.LocalPort)))
+}
+
+// Remote returns the address the server dials.
+func (m PortMapping) Remote() string {
+	host := m.RemoteHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(m.RemotePort)))
+}
+
+func (m PortMapping) String() string {
+	return m.Local() + " -> " + m.Remote()
+}
+
+// MappingError reports an invalid entry of the ports list.
+type MappingError struct {
+	Index int
+	Entry string
+	Err   error
+}
+
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("ports[%d] %q: %v", e.Index, e.Entry, e.Err)
+}
+
+func (e *MappingError) Unwrap() error { return e.Err }
+
+// ParsePorts parses every entry of the ports list, expanding ranges. The
+// error for a bad entry is a *MappingError naming it.
+func ParsePorts(ports []string) ([]PortMapping, error) {
+	out, errs := parsePorts(ports)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return out, nil
+}
+
+// portErrors returns a *MappingError for every bad entry of ports.
+func portErrors(ports []string) []error {
+	_, errs := parsePorts(ports)
+	return errs
+}
+
+func parsePorts(ports []string) ([]PortMapping, []error) {
+	var out []PortMapping
+	var errs []error
+	// the bind addresses taken on every local port, and by which entry
+	seen := make(map[uint16][]boundAt)
+	for i, entry := range ports {
+		ms, err := ParsePortMapping(entry)
+		if err != nil {
+			errs = append(errs, &MappingError{Index: i, Entry: entry, Err: err})
+			continue
+		}
+		for _, m := range ms {
+			ip := net.ParseIP(m.BindAddr)
+			if j, ok := clash(seen[m.LocalPort], ip); ok {
+				errs = append(errs, &MappingError{Index: i, Entry: entry, Err: fmt.Errorf("local %s already mapped by ports[%d]", m.Local(), j)})
+				break
+			}
+			seen[m.LocalPort] = append(seen[m.LocalPort], boundAt{ip, i})
+		}
+		out = append(out, ms...)
+	}
+	return out, errs
+}
+
+// boundAt is a bind address, nil for all addresses, taken by ports[index].
+type boundAt struct {
+	ip    net.IP
+	index int
+}
+
+// clash returns the index of the entry of bound that a listener on ip
+// can't share the port with: one on the same address, or either one on
+// all of them.
+func clash(bound []boundAt, ip net.IP) (int, bool) {
+	for _, b := range bound {
+		if b.ip == nil || b.ip.IsUnspecified() || ip == nil || ip.IsUnspecified() || b.ip.Equal(ip) {
+			return b.index, true
+		}
+	}
+	return 0, false
+}
+
+// ParsePortMapping parses one entry of the ports list.
+func ParsePortMapping(entry string) ([]PortMapping, error) {
+	fields, err := splitFields(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if f == "" {
+			return nil, errors.New("empty field")
+		}
+	}
+
+	var bind, local, host, remote string
+	switch len(fields) {
+	case 2:
+		local, remote = fields[0], fields[1]
+	case 3:
+		// a leading port means local:host:remote, anything else bind:local:remote
+		if isPortSpec(fields[0]) {
+			local, host, remote = fields[0], fields[1], fields[2]
+		} else {
+			bind, local, remote = fields[0], fields[1], fields[2]
+		}
+	case 4:
+		bind, local, host, remote = fields[0], fields[1], fields[2], fields[3]
+	default:
+		return nil, errors.New("want [bind:]local:[host:]remote")
+	}
+
+	if bind != "" && net.ParseIP(bind) == nil {
+		return nil, fmt.Errorf("bind address %q is not an IP address", bind)
+	}
+	if host != "" && !validHost(host) {
+		return nil, fmt.Errorf("invalid remote host %q", host)
+	}
+
+	lFirst, lLast, err := parsePortRange(local)
+	if err != nil {
+		return nil, fmt.Errorf("local %v", err)
+	}
+	rFirst, rLast, err := parsePortRange(remote)
+	if err != nil {
+		return nil, fmt.Errorf("remote %v", err)
+	}
+	if lLast-lFirst != rLast-rFirst {
+		return nil, fmt.Errorf("local range %s and remote range %s differ in length", local, remote)
+	}
+
+	out := make([]PortMapping, 0, lLast-lFirst+1)
+	for i := 0; i <= int(lLast-lFirst); i++ {
+		out = append(out, PortMapping{
+			BindAddr:   bind,
+			LocalPort:  lFirst + uint16(i),
+			RemoteHost: host,
+			RemotePort: rFirst + uint16(i),
+		})
+	}
+	return out, nil
+}
+
+// splitFields splits entry on colons outside of [brackets], stripping the
+// brackets from IPv6 addresses.
+func splitFields(entry string) ([]string, error) {
+	var fields []string
+	for rest := entry; ; {
+		var field string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, errors.New("missing ']'")
+			}
+			field, rest = rest[1:end], rest[end+1:]
+			if ip := net.ParseIP(field); ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("%q is not an IPv6 address", field)
+			}
+			if rest != "" && !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("unexpected %q after ']'", rest)
+			}
+		} else if i := strings.Index(rest, ":"); i >= 0 {
+			field, rest = rest[:i], rest[i:]
+		} else {
+			field, rest = rest, ""
+		}
+		fields = append(fields, field)
+		if rest == "" {
+			return fields, nil
+		}
+		rest = rest[1:]
+	}
+}
+
+func isPortSpec(s string) bool {
+	_, _, err := parsePortRange(s)
+	return err == nil
+}
+
+// parsePortRange parses "port" or "first-last".
+func parsePortRange(s string) (first, last uint16, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err = parsePort(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err = parsePort(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("range %q is reversed", s)
+	}
+	return first, last, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("port %q is not in 1-65535", s)
+	}
+	return uint16(p), nil
+}
+
+// validHost accepts IP addresses and DNS names.
+func validHost(h string) bool {
+	if net.ParseIP(h) != nil {
+		return true
+	}
+	if len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
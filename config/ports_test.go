@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  []PortMapping
+	}{
+		{"8088:8080", []PortMapping{{LocalPort: 8088, RemotePort: 8080}}},
+		{"127.0.0.1:8088:5432", []PortMapping{{BindAddr: "127.0.0.1", LocalPort: 8088, RemotePort: 5432}}},
+		{"8088:db.internal:5432", []PortMapping{{LocalPort: 8088, RemoteHost: "db.internal", RemotePort: 5432}}},
+		{"127.0.0.1:8088:db.internal:5432", []PortMapping{{BindAddr: "127.0.0.1", LocalPort: 8088, RemoteHost: "db.internal", RemotePort: 5432}}},
+		{"[::1]:8088:[fd00::5]:5432", []PortMapping{{BindAddr: "::1", LocalPort: 8088, RemoteHost: "fd00::5", RemotePort: 5432}}},
+		{"7000-7002:9000-9002", []PortMapping{
+			{LocalPort: 7000, RemotePort: 9000},
+			{LocalPort: 7001, RemotePort: 9001},
+			{LocalPort: 7002, RemotePort: 9002},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortMapping(tt.entry)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.entry, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%q: got %v want %v", tt.entry, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%q: got %v want %v", tt.entry, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestParsePortMappingErrors(t *testing.T) {
+	for _, entry := range []string{
+		"8088",
+		"8088:0",
+		"8088:70000",
+		"7000-7010:9000-9005",
+		"7010-7000:9010-9000",
+		"localhost:8088:8080",
+		"[::1:8088:8080",
+		"[10.0.0.1]:8088:8080",
+		"8088:bad_host!:5432",
+		"1:2:3:4:5",
+		":8088:8080",
+	} {
+		if _, err := ParsePortMapping(entry); err == nil {
+			t.Errorf("%q: expected error", entry)
+		}
+	}
+}
+
+func TestParsePortsNamesEntry(t *testing.T) {
+	_, err := ParsePorts([]string{"8088:8080", "9001:x"})
+	var me *MappingError
+	if !errors.As(err, &me) || me.Index != 1 || me.Entry != "9001:x" {
+		t.Fatalf("expected MappingError for ports[1], got %v", err)
+	}
+
+	_, err = ParsePorts([]string{"7000-7005:9000-9005", "7003:22"})
+	if !errors.As(err, &me) || me.Index != 1 || !strings.Contains(err.Error(), "ports[0]") {
+		t.Fatalf("expected overlap error naming ports[0], got %v", err)
+	}
+
+	// all addresses, however written, overlap every other bind address
+	for _, ports := range [][]string{
+		{"8088:8080", "0.0.0.0:8088:8081"},
+		{"[::]:8088:8080", "127.0.0.1:8088:8081"},
+		{"127.0.0.1:8088:8080", "127.0.0.1:8088:8081"},
+	} {
+		if _, err := ParsePorts(ports); !errors.As(err, &me) || me.Index != 1 {
+			t.Errorf("%q: expected overlap error for ports[1], got %v", ports, err)
+		}
+	}
+	if _, err := ParsePorts([]string{"127.0.0.1:8088:8080", "[::1]:8088:8081"}); err != nil {
+		t.Errorf("distinct bind addresses: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"text/template"
+
+	codec "icmp-tunnel/pkg"
+)
+
+var starter = template.Must(template.New("starter").Parse(`# Tunnel {{.Mode}} configuration, generated by "tunnel config init".
+#
+# Every option below can be overridden by a TUNNEL_<OPTION> environment
+# variable (TUNNEL_KEY_FILE for key_file) or a -<option> flag (-key-file).
+# "tunnel -print-config" shows the merged result.
+
+[config]
+# "agent" listens on the local ports and carries the traffic through the
+# tunnel; "server" receives it and connects to the remote ports.
+mode = "{{.Mode}}"
+
+# Carrier between agent and server: "icmp" (echo requests and replies),
+# "faketcp" (TCP-looking segments over UDP), "faketcp-raw" (genuine TCP
+# segments on a raw socket, needs root), "udp" (plain datagrams), "dns"
+# (queries to the server as the name server of a domain) or "http"
+# (WebSockets or long polling, through the proxy in HTTP_PROXY if set).
+# A comma-separated list such as "faketcp,icmp" is tried in order by an
+# agent, which falls back when one stops working; a server listens on all.
+# Names joined with "+", such as "icmp+faketcp", use both at once.
+transport = "icmp"
+{{if eq .Mode "agent"}}
+# Address of the tunnel server; add ":port" for faketcp and faketcp-raw
+# (default 4000), http (default 80) and udp. icmp runs over ICMPv6 to an IPv6 address. For
+# dns give the tunnel domain, and "@resolver" unless the system one works.
+server = "{{.Server}}"
+{{else}}
+# Address faketcp (default ":4000"), udp, dns (default ":53") and http
+# (default ":80") listen on, and the TCP port of faketcp-raw; icmp needs
+# none.
+# listen = ":4000"
+
+# icmp needs the kernel to leave echo requests to the server, as firewalls
+# and NATs often pass a single reply per request and its own would go first:
+#   sysctl -w net.ipv4.icmp_echo_ignore_all=1 net.ipv6.icmp.echo_ignore_all=1
+{{end}}
+# Pre-shared key, the same on agent and server: 32 random bytes (AES-256).
+# To keep it out of this file use key_file, key_env or key_command (run once
+# at start with sh -c) instead, and to type a passphrase add a [config.kdf]
+# table with algorithm = "scrypt".
+key = "hex:{{.Key}}"
+
+# Forwarded protocol: "tcp" or "udp".
+type = "tcp"
+
+# Port mappings as [bind:]local:[host:]remote. Ranges of equal length such as
+# "7000-7010:9000-9010" map port by port; IPv6 addresses go in brackets.
+{{- if eq .Mode "server"}}
+# The server only connects to the remote side of the mappings listed here,
+# so keep them in line with the agent's.
+{{- end}}
+ports = ["8088:8080"]
+
+# More tunnels can run from the same file; they inherit the keys above that
+# they leave unset, except ports, and need a key of their own on a server.
+#
+# [[tunnel]]
+# name = "db"
+# key_file = "/etc/tunnel/db.key"
+# ports = ["127.0.0.1:5432:db.internal:5432"]
+`))
+
+// Starter returns a commented configuration file for mode ("agent" or
+// "server") with a freshly generated random key.
+func Starter(mode, server string) ([]byte, error) {
+	if mode != "agent" && mode != "server" {
+		return nil, fmt.Errorf("unknown mode %q (want \"agent\" or \"server\")", mode)
+	}
+	key, err := codec.RandBytes(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %v", err)
+	}
+	var buf bytes.Buffer
+	err = starter.Execute(&buf, struct{ Mode, Server, Key string }{mode, server, hex.EncodeToString(key)})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// The client polls again right away after an answer with data and backs
+// off between pollMin and pollMax while there is none.
+const (
+	pollMin = 20 * time.Millisecond
+	pollMax = 2 * time.Second
+	// pollLost is how long a poll may go unanswered.
+	pollLost = holdTime + 2*time.Second
+)
+
+// Conn is a tunnel to a DNS server. Every Write goes out as queries, every
+// message the server answers with is returned by one Read.
+type Conn struct {
+	*msgconn.Conn
+	pc      *net.UDPConn
+	key     []byte
+	domain  string
+	qtype   uint16
+	session uint16
+
+	mu  sync.Mutex
+	seq uint16
+
+	// pollID is the ID of the outstanding poll, whose answer goes to polled
+	pollID atomic.Uint32
+	polled chan bool
+	kick   chan struct{}
+}
+
+// Dial opens a tunnel through the resolver addr names; see splitAddr for
+// its forms. Like UDP it sends nothing to check the server is there.
+func Dial(ctx context.Context, addr string, opts Options) (*Conn, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	domain, resolver, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	rand.Read(b[:])
+	c := &Conn{
+		pc:      pc,
+		key:     opts.Key,
+		domain:  domain,
+		qtype:   opts.qtype(),
+		session: binary.BigEndian.Uint16(b[:]),
+		polled:  make(chan bool, 1),
+		kick:    make(chan struct{}, 1),
+	}
+	c.pollID.Store(1 << 16) // matches no ID until the first poll
+	c.Conn = msgconn.New(pc.LocalAddr(), raddr, c.send, pc.Close)
+	go c.readLoop()
+	go c.pollLoop()
+	return c, nil
+}
+
+// Session returns the ID the server tells this tunnel apart by.
+func (c *Conn) Session() uint16 { return c.session }
+
+func (c *Conn) send(msg []byte) error {
+	sealed, err := codec.EncryptAES(c.key, msg)
+	if err != nil {
+		return err
+	}
+	size := fragmentSize(c.domain) - 6
+	if len(sealed) > 255*size {
+		return fmt.Errorf("dns: %d byte message does not fit in 255 queries", len(msg))
+	}
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+	frags, err := codec.SimpleFragment(c.session, seq, sealed, size)
+	if err != nil {
+		return err
+	}
+	for _, frag := range frags {
+		if err := c.query(randID(), frag); err != nil {
+			return err
+		}
+	}
+	// an answer may follow
+	c.poke()
+	return nil
+}
+
+// query sends frag, or a poll if it is nil, in a query with the given ID.
+func (c *Conn) query(id uint16, frag []byte) error {
+	var b [4]byte
+	rand.Read(b[:])
+	h := tunHeader{session: c.session, nonce: binary.BigEndian.Uint32(b[:])}
+	_, err := c.pc.Write(buildQuery(id, encodeName(c.key, h, frag, c.domain), c.qtype))
+	return err
+}
+
+func randID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (c *Conn) poke() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) readLoop() {
+	reasm := codec.NewReassembler(5 * time.Second)
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.pc.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		id, rdata, err := parseResponse(buf[:n], c.qtype)
+		if err != nil || rdata == nil {
+			continue
+		}
+		if c.qtype == typeTXT {
+			if rdata, err = fromTXT(rdata); err != nil {
+				continue
+			}
+		}
+		if len(rdata) == 0 {
+			continue
+		}
+		if uint32(id) == c.pollID.Load() {
+			select {
+			case c.polled <- len(rdata) > 1:
+			default:
+			}
+		}
+		if rdata[0]&moreFlag != 0 {
+			c.poke()
+		}
+		if len(rdata) == 1 {
+			continue
+		}
+		sess, seq, idx, total, data, err := codec.ParseFragmentPayload(rdata[1:])
+		if err != nil || sess != c.session {
+			continue
+		}
+		data = append([]byte(nil), data...)
+		complete, assembled, err := reasm.AddFragment(sess, seq, idx, total, data)
+		if err != nil || !complete {
+			continue
+		}
+		if msg, err := codec.DecryptAES(c.key, assembled); err == nil {
+			c.Deliver(msg)
+		}
+	}
+}
+
+// pollLoop keeps a poll outstanding so the server can answer with what it
+// has, backing off while it has nothing.
+func (c *Conn) pollLoop() {
+	var delay time.Duration
+	for {
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-c.kick:
+				timer.Stop()
+			case <-c.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		id := randID()
+		c.pollID.Store(uint32(id))
+		select {
+		case <-c.polled:
+		default:
+		}
+		if err := c.query(id, nil); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = pollMax
+			continue
+		}
+
+		timer := time.NewTimer(pollLost)
+		select {
+		case data := <-c.polled:
+			if data {
+				delay = 0
+			} else {
+				delay = min(max(2*delay, pollMin), pollMax)
+			}
+		case <-timer.C:
+			delay = pollMin
+		case <-c.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
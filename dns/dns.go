@@ -0,0 +1,93 @@
+// Package dns carries messages in DNS queries and answers, for networks
+// that let nothing but DNS out.
+//
+// A client sends each message sealed with AES-GCM and split by
+// pkg.SimpleFragment, one fragment per query, base32 in the labels of a
+// name under the tunnel domain. The server is the authoritative name
+// server of that domain: it answers with TXT (or NULL) records carrying
+// its messages, fragmented the same way. As the server can only speak when
+// asked, the client keeps a poll query outstanding, which the server holds
+// for a moment waiting for something to send.
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// holdTime is how long the server keeps a query waiting for a
+	// message to answer with; resolvers give up not long after.
+	holdTime = 400 * time.Millisecond
+	// downSize is the most fragment bytes one answer carries, which keeps
+	// responses within the 1232 bytes resolvers accept over UDP.
+	downSize = 900
+	// moreFlag in the first byte of an answer tells the client the server
+	// has more queued.
+	moreFlag = 1
+	// sessionIdle closes server sessions that sent no query for that long.
+	sessionIdle = 5 * time.Minute
+	// maxQueued bounds the answers a server session has waiting for a
+	// query; more messages are dropped.
+	maxQueued = 512
+)
+
+// Options configures Dial and Listen. Only Key is required.
+type Options struct {
+	// Key authenticates queries and seals messages; it must be 16, 24 or
+	// 32 bytes.
+	Key []byte
+	// NULL has the client ask for NULL records, which carry raw bytes,
+	// instead of TXT records. Some resolvers do not pass them.
+	NULL bool
+}
+
+func (o Options) check() error {
+	switch len(o.Key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("dns: key must be 16, 24 or 32 bytes, got %d", len(o.Key))
+}
+
+func (o Options) qtype() uint16 {
+	if o.NULL {
+		return typeNULL
+	}
+	return typeTXT
+}
+
+// resolvConf is where the system resolver is looked up.
+var resolvConf = "/etc/resolv.conf"
+
+// splitAddr reads a Dial address: "domain@resolver" queries resolver for
+// names under domain, a bare "domain" the system resolver, and a
+// "host:port" the tunnel server directly, with no domain.
+func splitAddr(addr string) (domain, resolver string, err error) {
+	if domain, resolver, ok := strings.Cut(addr, "@"); ok {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+		}
+		return domain, resolver, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return "", addr, nil
+	}
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			return addr, net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", "", errors.New("dns: no nameserver in " + resolvConf)
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("dns-tunnel-key!!")
+
+// resolver is a stand-in for a recursive resolver on loopback: it
+// forwards every query to the server under an ID of its own and with the
+// case of the name scrambled, as resolvers using 0x20 encoding do, and
+// relays the answers back as they were asked.
+func resolver(t *testing.T, server net.Addr) string {
+	t.Helper()
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.DialUDP("udp", nil, server.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { front.Close(); back.Close() })
+
+	type asked struct {
+		from *net.UDPAddr
+		id   uint16
+		raw  []byte
+	}
+	var mu sync.Mutex
+	pending := make(map[uint16]asked)
+	var next uint16
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q, err := parseQuery(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			next++
+			id := next
+			pending[id] = asked{from, q.id, q.raw}
+			mu.Unlock()
+			fwd := append([]byte(nil), buf[:n]...)
+			binary.BigEndian.PutUint16(fwd, id)
+			for i := headerLen; i < headerLen+len(q.raw)-4; i++ {
+				if c := fwd[i]; c >= 'a' && c <= 'z' && i%2 == 0 {
+					fwd[i] = c - 'a' + 'A'
+				}
+			}
+			back.Write(fwd)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			a, ok := pending[binary.BigEndian.Uint16(buf)]
+			delete(pending, binary.BigEndian.Uint16(buf))
+			mu.Unlock()
+			if !ok {
+				continue
+			}
+			resp := append([]byte(nil), buf[:n]...)
+			binary.BigEndian.PutUint16(resp, a.id)
+			copy(resp[headerLen:], a.raw)
+			front.WriteToUDP(resp, a.from)
+		}
+	}()
+	return front.LocalAddr().String()
+}
+
+// prefixEcho answers every message of every session with prefix+message.
+func prefixEcho(t *testing.T, l *Listener, prefix string) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 65535)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(append([]byte(prefix), buf[:n]...))
+				}
+			}()
+		}
+	}()
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	h := tunHeader{session: 0xbeef, nonce: 42}
+	for _, domain := range []string{"", "t.example.com", strings.Repeat("long.", 30) + "example"} {
+		frag := bytes.Repeat([]byte{0xa5}, fragmentSize(domain))
+		name := encodeName(testKey, h, frag, domain)
+		if len(name) > maxName {
+			t.Fatalf("name under %q is %d chars long", domain, len(name))
+		}
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > maxLabel {
+				t.Fatalf("label %q too long", label)
+			}
+		}
+		got, data, ok := decodeName(testKey, strings.ToUpper(name))
+		if !ok || got.session != h.session || got.nonce != h.nonce || !bytes.Equal(data, frag) {
+			t.Fatalf("decodeName(%q) = %+v %x %v", name, got, data, ok)
+		}
+		if _, _, ok := decodeName([]byte("another-test-key"), name); ok {
+			t.Fatal("name decoded under another key")
+		}
+	}
+}
+
+func TestDialThroughResolver(t *testing.T) {
+	for _, opts := range []Options{{Key: testKey}, {Key: testKey, NULL: true}} {
+		t.Run(fmt.Sprintf("NULL=%v", opts.NULL), func(t *testing.T) {
+			l, err := Listen("127.0.0.1:0", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefixEcho(t, l, "echo: ")
+			c, err := Dial(context.Background(), "t.example.com@"+resolver(t, l.Addr()), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			buf := make([]byte, 65535)
+			// the big one takes many queries up and many polls down
+			for _, msg := range []string{"hello", string(bytes.Repeat([]byte("0123456789"), 600))} {
+				if _, err := c.Write([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				c.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, err := c.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf[:n]) != "echo: "+msg {
+					t.Fatalf("reply = %.20q..., want %.20q...", buf[:n], "echo: "+msg)
+				}
+			}
+		})
+	}
+}
+
+func TestServerPushesThroughPolls(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", Options{Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c, err := Dial(context.Background(), l.Addr().String(), Options{Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the first poll opens the session without a message
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.(*Session).ID(); got != c.Session() {
+		t.Fatalf("session %04x, want %04x", got, c.Session())
+	}
+	s.Write([]byte("unasked"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "unasked" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestSplitAddr(t *testing.T) {
+	resolvConf = t.TempDir() + "/resolv.conf"
+	if err := os.WriteFile(resolvConf, []byte("# test\nsearch example.com\nnameserver 192.0.2.53\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string][2]string{
+		"t.example.com@10.0.0.1":   {"t.example.com", "10.0.0.1:53"},
+		"t.example.com@[::1]:5353": {"t.example.com", "[::1]:5353"},
+		"127.0.0.1:5353":           {"", "127.0.0.1:5353"},
+		"t.example.com":            {"t.example.com", "192.0.2.53:53"},
+	} {
+		domain, res, err := splitAddr(addr)
+		if err != nil || domain != want[0] || res != want[1] {
+			t.Errorf("splitAddr(%q) = %q, %q, %v; want %q", addr, domain, res, err, want)
+		}
+	}
+}
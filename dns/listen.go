@@ -0,0 +1,309 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// Listener is an authoritative name server that accepts tunnel sessions.
+// It answers any query whose name carries a valid tunnel header, whatever
+// the domain, and every other query with an empty answer.
+type Listener struct {
+	pc   *net.UDPConn
+	opts Options
+
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	sessions map[uint16]*Session
+}
+
+// Session is the server side of one client tunnel. Read returns the
+// messages the client writes; Write queues a message for the answers to
+// the client's next queries.
+type Session struct {
+	*msgconn.Conn
+	l  *Listener
+	id uint16
+	// reasm is only used by the listener's read loop
+	reasm *codec.Reassembler
+
+	mu  sync.Mutex
+	seq uint16
+	// held are queries waiting for queued answers, oldest first
+	held   []heldQuery
+	queued [][]byte
+	// seen holds recent query nonces, to drop resolver retransmissions
+	seen     map[uint32]time.Time
+	lastSeen time.Time
+}
+
+type heldQuery struct {
+	q    *question
+	from *net.UDPAddr
+	at   time.Time
+}
+
+// answer is a response ready to go out.
+type answer struct {
+	pkt []byte
+	to  *net.UDPAddr
+}
+
+// Listen serves DNS on the UDP address addr for clients that know
+// opts.Key.
+func Listen(addr string, opts Options) (*Listener, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		pc:       pc,
+		opts:     opts,
+		accept:   make(chan net.Conn, 64),
+		done:     make(chan struct{}),
+		sessions: make(map[uint16]*Session),
+	}
+	go l.readLoop()
+	go l.tickLoop()
+	return l, nil
+}
+
+// Accept waits for the next client session.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops answering and closes every session.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.pc.Close()
+		l.mu.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[uint16]*Session)
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+func (l *Listener) send(answers []answer) {
+	for _, a := range answers {
+		l.pc.WriteToUDP(a.pkt, a.to)
+	}
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := l.pc.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		// the question aliases buf only until it is answered or copied
+		q, err := parseQuery(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		h, frag, ok := decodeName(l.opts.Key, q.name)
+		if !ok || (q.qtype != typeTXT && q.qtype != typeNULL) {
+			// not ours: no data, which also keeps resolvers that minimise
+			// query names walking down to the tunnel names
+			l.send([]answer{{buildResponse(q, 0, nil), from}})
+			continue
+		}
+		s := l.session(h.session, from)
+		if s == nil {
+			l.send([]answer{{buildResponse(q, rcodeRefused, nil), from}})
+			continue
+		}
+		l.send(s.query(q, from, h, frag))
+	}
+}
+
+// session returns the session with the given ID, starting one if there is
+// none. It returns nil if the accept backlog is full.
+func (l *Listener) session(id uint16, from net.Addr) *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.sessions[id]; ok {
+		return s
+	}
+	s := &Session{
+		l:        l,
+		id:       id,
+		reasm:    codec.NewReassembler(5 * time.Second),
+		seen:     make(map[uint32]time.Time),
+		lastSeen: time.Now(),
+	}
+	s.Conn = msgconn.New(l.pc.LocalAddr(), from, s.reply, func() error {
+		l.mu.Lock()
+		if l.sessions[id] == s {
+			delete(l.sessions, id)
+		}
+		l.mu.Unlock()
+		return nil
+	})
+	select {
+	case l.accept <- s:
+	default:
+		return nil
+	}
+	l.sessions[id] = s
+	return s
+}
+
+// ID returns the session ID the client chose.
+func (s *Session) ID() uint16 { return s.id }
+
+// query takes in one query of the session. Queries that complete a
+// message, and polls, are held for a reply; the rest are answered at once.
+func (s *Session) query(q *question, from *net.UDPAddr, h tunHeader, frag []byte) []answer {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastSeen = now
+	if _, dup := s.seen[h.nonce]; dup {
+		s.mu.Unlock()
+		return nil
+	}
+	s.seen[h.nonce] = now
+	s.mu.Unlock()
+
+	hold := len(frag) == 0
+	if len(frag) > 0 {
+		sess, seq, idx, total, data, err := codec.ParseFragmentPayload(frag)
+		if err == nil && sess == s.id {
+			complete, assembled, err := s.reasm.AddFragment(sess, seq, idx, total, data)
+			if err == nil && complete {
+				if msg, err := codec.DecryptAES(s.l.opts.Key, assembled); err == nil {
+					s.Deliver(msg)
+					hold = true
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hold || len(s.queued) > 0 {
+		s.held = append(s.held, heldQuery{q, from, now})
+		return s.dispatch()
+	}
+	return []answer{{s.response(q, nil), from}}
+}
+
+// reply is the msgconn send function: it queues msg for the next queries.
+func (s *Session) reply(msg []byte) error {
+	sealed, err := codec.EncryptAES(s.l.opts.Key, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.seq++
+	frags, err := codec.SimpleFragment(s.id, s.seq, sealed, downSize-6)
+	if err != nil || len(s.queued)+len(frags) > maxQueued {
+		s.mu.Unlock()
+		return err
+	}
+	s.queued = append(s.queued, frags...)
+	answers := s.dispatch()
+	s.mu.Unlock()
+	s.l.send(answers)
+	return nil
+}
+
+// dispatch answers held queries with queued fragments. s.mu must be held.
+func (s *Session) dispatch() []answer {
+	var out []answer
+	for len(s.held) > 0 && len(s.queued) > 0 {
+		h := s.held[0]
+		s.held = s.held[1:]
+		frag := s.queued[0]
+		s.queued = s.queued[1:]
+		out = append(out, answer{s.response(h.q, frag), h.from})
+	}
+	return out
+}
+
+// response answers q with frag, or with nothing but the flags if frag is
+// nil. s.mu must be held.
+func (s *Session) response(q *question, frag []byte) []byte {
+	var flags byte
+	if len(s.queued) > 0 {
+		flags |= moreFlag
+	}
+	payload := append([]byte{flags}, frag...)
+	if q.qtype == typeTXT {
+		payload = txtData(payload)
+	}
+	return buildResponse(q, 0, payload)
+}
+
+// tickLoop answers queries held for holdTime with nothing and closes idle
+// sessions.
+func (l *Listener) tickLoop() {
+	tick := time.NewTicker(holdTime / 8)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-l.done:
+			return
+		}
+		l.mu.Lock()
+		sessions := make([]*Session, 0, len(l.sessions))
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+		l.mu.Unlock()
+
+		for _, s := range sessions {
+			var out []answer
+			s.mu.Lock()
+			for len(s.held) > 0 && now.Sub(s.held[0].at) >= holdTime {
+				out = append(out, answer{s.response(s.held[0].q, nil), s.held[0].from})
+				s.held = s.held[1:]
+			}
+			for nonce, t := range s.seen {
+				if now.Sub(t) > time.Minute {
+					delete(s.seen, nonce)
+				}
+			}
+			idle := now.Sub(s.lastSeen) > sessionIdle
+			s.mu.Unlock()
+			l.send(out)
+			if idle {
+				s.Close()
+			}
+		}
+	}
+}
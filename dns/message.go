@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Resource record types and classes the tunnel uses.
+const (
+	typeNULL = 10
+	typeTXT  = 16
+	typeOPT  = 41
+	classIN  = 1
+)
+
+// Header flags and response codes.
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+const (
+	headerLen = 12
+	// ednsSize is the UDP payload size advertised in the OPT record.
+	ednsSize = 4096
+	// maxName is the longest name in presentation form, without the
+	// final dot.
+	maxName = 253
+)
+
+var errMalformed = errors.New("dns: malformed message")
+
+// question is the single question of a query.
+type question struct {
+	id    uint16
+	flags uint16
+	name  string
+	qtype uint16
+	// raw is the question section as it came, echoed in the response
+	raw []byte
+}
+
+// appendName appends name in wire form, uncompressed.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes the name at off, following compression pointers, and
+// returns it with the offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case n&0xc0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// appendOPT appends the EDNS(0) pseudo record advertising ednsSize.
+func appendOPT(b []byte) []byte {
+	b = append(b, 0) // root name
+	b = binary.BigEndian.AppendUint16(b, typeOPT)
+	b = binary.BigEndian.AppendUint16(b, ednsSize)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	return binary.BigEndian.AppendUint16(b, 0)
+}
+
+// buildQuery returns a recursive query for name, with EDNS(0).
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRD)
+	binary.BigEndian.PutUint16(b[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(b[10:], 1) // ARCOUNT
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	return appendOPT(b)
+}
+
+// parseQuery reads the question of a query.
+func parseQuery(msg []byte) (*question, error) {
+	if len(msg) < headerLen {
+		return nil, errMalformed
+	}
+	q := &question{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	if q.flags&flagQR != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errMalformed
+	}
+	name, off, err := readName(msg, headerLen)
+	if err != nil || off+4 > len(msg) {
+		return nil, errMalformed
+	}
+	q.name = name
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	q.raw = msg[headerLen : off+4]
+	return q, nil
+}
+
+// buildResponse answers q authoritatively with rcode and, if rdata is not
+// nil, one record of the type asked for holding it.
+func buildResponse(q *question, rcode int, rdata []byte) []byte {
+	b := make([]byte, headerLen, headerLen+len(q.raw)+16+len(rdata)+11)
+	binary.BigEndian.PutUint16(b[0:], q.id)
+	binary.BigEndian.PutUint16(b[2:], flagQR|flagAA|q.flags&flagRD|uint16(rcode))
+	binary.BigEndian.PutUint16(b[4:], 1)
+	if rdata != nil {
+		binary.BigEndian.PutUint16(b[6:], 1)
+	}
+	binary.BigEndian.PutUint16(b[10:], 1)
+	b = append(b, q.raw...)
+	if rdata != nil {
+		b = binary.BigEndian.AppendUint16(b, 0xc000|headerLen) // the question name
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+		b = binary.BigEndian.AppendUint32(b, 0) // TTL: never cache
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+	}
+	return appendOPT(b)
+}
+
+// parseResponse returns the ID of a response and the RDATA of its first
+// answer of type qtype, nil if it has none.
+func parseResponse(msg []byte, qtype uint16) (uint16, []byte, error) {
+	if len(msg) < headerLen {
+		return 0, nil, errMalformed
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagQR == 0 {
+		return 0, nil, errMalformed
+	}
+	if flags&flagTC != 0 {
+		return id, nil, errors.New("dns: truncated response")
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	off := headerLen
+	for i := 0; i < qd; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return id, nil, errMalformed
+		}
+		off = next + 4
+	}
+	for i := 0; i < an; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return id, nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		n := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10
+		if off+n > len(msg) {
+			return id, nil, errMalformed
+		}
+		if typ == qtype {
+			return id, msg[off : off+n], nil
+		}
+		off += n
+	}
+	return id, nil, nil
+}
+
+// txtData packs b into the character strings of a TXT record.
+func txtData(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/255+1)
+	for {
+		n := min(len(b), 255)
+		out = append(out, byte(n))
+		out = append(out, b[:n]...)
+		b = b[n:]
+		if len(b) == 0 {
+			return out
+		}
+	}
+}
+
+// fromTXT joins the character strings of a TXT record.
+func fromTXT(rdata []byte) ([]byte, error) {
+	var out []byte
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if 1+n > len(rdata) {
+			return nil, errMalformed
+		}
+		out = append(out, rdata[1:1+n]...)
+		rdata = rdata[1+n:]
+	}
+	return out, nil
+}
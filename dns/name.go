@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"encoding/base32"
+	"encoding/binary"
+	"strings"
+
+	codec "icmp-tunnel/pkg"
+)
+
+// A query name is <header>.<data>.<domain>. The header label is the base32
+// of labels(1) session(2) nonce(4) tag(4): labels counts the data labels
+// after it, so the server finds the data without knowing its domain; the
+// nonce keeps resolvers from answering from their cache; tag is a
+// truncated HMAC of the rest under the key. The data labels are the
+// base32 of one fragment from pkg.SimpleFragment; a poll has none.
+const (
+	tunHeaderLen = 11
+	tagLen       = 4
+	maxLabel     = 63
+)
+
+// b32 is case-insensitive on decoding, as resolvers may change the case
+// of names they forward.
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// tunHeader is the header label of a query.
+type tunHeader struct {
+	labels  uint8
+	session uint16
+	nonce   uint32
+}
+
+func tag(key, b []byte) []byte {
+	return codec.ComputeHMAC(key, b)[:tagLen]
+}
+
+// encodeName returns the query name carrying frag, or a poll if frag is
+// empty, under domain.
+func encodeName(key []byte, h tunHeader, frag []byte, domain string) string {
+	data := strings.ToLower(b32.EncodeToString(frag))
+	var labels []string
+	for len(data) > 0 {
+		n := min(len(data), maxLabel)
+		labels = append(labels, data[:n])
+		data = data[n:]
+	}
+
+	hb := make([]byte, 0, tunHeaderLen)
+	hb = append(hb, byte(len(labels)))
+	hb = binary.BigEndian.AppendUint16(hb, h.session)
+	hb = binary.BigEndian.AppendUint32(hb, h.nonce)
+	hb = append(hb, tag(key, hb)...)
+
+	name := strings.ToLower(b32.EncodeToString(hb))
+	if len(labels) > 0 {
+		name += "." + strings.Join(labels, ".")
+	}
+	if domain = strings.Trim(domain, "."); domain != "" {
+		name += "." + domain
+	}
+	return name
+}
+
+// decodeName reverses encodeName. It reports false for names that are not
+// tunnel queries under key.
+func decodeName(key []byte, name string) (tunHeader, []byte, bool) {
+	var h tunHeader
+	labels := strings.Split(name, ".")
+	hb, err := b32.DecodeString(strings.ToUpper(labels[0]))
+	if err != nil || len(hb) != tunHeaderLen || !hmac.Equal(hb[tunHeaderLen-tagLen:], tag(key, hb[:tunHeaderLen-tagLen])) {
+		return h, nil, false
+	}
+	h.labels = hb[0]
+	h.session = binary.BigEndian.Uint16(hb[1:])
+	h.nonce = binary.BigEndian.Uint32(hb[3:])
+	if int(h.labels) > len(labels)-1 {
+		return h, nil, false
+	}
+	frag, err := b32.DecodeString(strings.ToUpper(strings.Join(labels[1:1+h.labels], "")))
+	if err != nil {
+		return h, nil, false
+	}
+	return h, frag, true
+}
+
+// fragmentSize returns how many bytes of fragment fit in one query name
+// under domain.
+func fragmentSize(domain string) int {
+	room := maxName - len(b32.EncodeToString(make([]byte, tunHeaderLen)))
+	if domain = strings.Trim(domain, "."); domain != "" {
+		room -= len(domain) + 1
+	}
+	// chars, plus the dot before every data label
+	chars := room
+	for chars+(chars+maxLabel-1)/maxLabel > room {
+		chars--
+	}
+	return chars * 5 / 8
+}
@@ -0,0 +1,161 @@
+package faketcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// rtoMin and rtoMax bound the retransmission timeout of a segment.
+const (
+	rtoMin = 200 * time.Millisecond
+	rtoMax = 2 * time.Second
+)
+
+var errNoAck = errors.New("faketcp: no ack")
+
+// proof authenticates one side of the handshake: the client sends it over
+// its nonce, the server over the nonce and its own sequence number.
+func proof(psk, nonce []byte, extra ...byte) []byte {
+	m := hmac.New(sha256.New, psk)
+	m.Write(nonce)
+	m.Write(extra)
+	return m.Sum(nil)
+}
+
+// endpoint is one side of an established connection. Both the client and
+// the server side run the same data transfer: each message is one PSH
+// segment numbered from the handshake sequence number, sent until ACKed.
+type endpoint struct {
+	*msgconn.Conn
+	id   uint16
+	key  []byte
+	opts Options
+	// out writes one segment to the peer
+	out func([]byte) error
+
+	// wmu makes writers take turns, one segment in flight at a time
+	wmu  sync.Mutex
+	seq  uint32
+	acks chan uint32
+
+	rmu    sync.Mutex
+	expect uint32
+
+	lastSeen atomic.Int64
+}
+
+func newEndpoint(id uint16, opts Options, seq, peerSeq uint32, out func([]byte) error) *endpoint {
+	e := &endpoint{
+		id:     id,
+		key:    opts.Key,
+		opts:   opts,
+		out:    out,
+		seq:    seq,
+		acks:   make(chan uint32, 16),
+		expect: peerSeq + 1,
+	}
+	e.lastSeen.Store(time.Now().UnixNano())
+	return e
+}
+
+// send is the msgconn send function: it seals msg and delivers it.
+func (e *endpoint) send(msg []byte) error {
+	sealed, err := codec.EncryptAES(e.key, msg)
+	if err != nil {
+		return err
+	}
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+	e.seq++
+	seq := e.seq
+	pkt := packet(hdr{Ver: version, Flags: FlagPSH, Conn: e.id, Win: window, Seq: seq}, sealed)
+
+	deadline := e.WriteDeadline()
+	rto := rtoMin
+	for try := 0; try < e.opts.Retries; try++ {
+		if err := e.out(pkt); err != nil {
+			return err
+		}
+		wait := rto
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			wait = min(wait, left)
+		}
+		timer := time.NewTimer(wait)
+	waitAck:
+		for {
+			select {
+			case ack := <-e.acks:
+				if ack == seq {
+					timer.Stop()
+					return nil
+				}
+			case <-timer.C:
+				break waitAck
+			case <-e.Done():
+				timer.Stop()
+				return io.ErrClosedPipe
+			}
+		}
+		rto = min(2*rto, rtoMax)
+	}
+	return errNoAck
+}
+
+// handle processes one segment from the peer.
+func (e *endpoint) handle(h hdr, payload []byte) {
+	e.lastSeen.Store(time.Now().UnixNano())
+	switch {
+	case h.Flags&FlagFIN != 0:
+		e.out(marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: e.id, Win: window, Ack: h.Seq}))
+		e.CloseWithError(io.EOF)
+	case h.Flags&FlagPSH != 0:
+		e.rmu.Lock()
+		defer e.rmu.Unlock()
+		if h.Seq == e.expect {
+			msg, err := codec.DecryptAES(e.key, payload)
+			if err != nil {
+				return
+			}
+			if !e.Deliver(msg) {
+				// not acknowledged, so the peer sends it again
+				return
+			}
+			e.expect++
+		} else if h.Seq-e.expect < 1<<31 {
+			// ahead of what we have; the peer only sends the next one
+			return
+		}
+		// new or a retransmission of one we already have
+		e.out(marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: e.id, Win: window, Ack: h.Seq}))
+	case h.Flags&FlagACK != 0:
+		select {
+		case e.acks <- h.Ack:
+		default:
+		}
+	}
+}
+
+// fin tells the peer the connection is closed, without waiting for the ACK.
+func (e *endpoint) fin() {
+	e.wmu.Lock()
+	seq := e.seq + 1
+	e.wmu.Unlock()
+	e.out(marshalHeader(hdr{Ver: version, Flags: FlagFIN, Conn: e.id, Win: window, Seq: seq}))
+}
+
+func (e *endpoint) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, e.lastSeen.Load()))
+}
@@ -0,0 +1,136 @@
+package faketcp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+)
+
+// Dial connects to the faketcp server at addr, authenticating both ends
+// with opts.Key. Each Write on the returned conn is delivered as one
+// message to a Read on the server.
+func Dial(ctx context.Context, addr string, opts Options) (net.Conn, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	var pc net.Conn
+	if opts.Raw {
+		raddr, err := net.ResolveTCPAddr("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := dialRaw(raddr)
+		if err != nil {
+			return nil, err
+		}
+		pc = rc
+	} else {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		uc, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			return nil, err
+		}
+		pc = uc
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.HandshakeTimeout)
+		defer cancel()
+	}
+	e, err := handshake(ctx, pc, opts)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("faketcp: handshake with %s: %w", addr, err)
+	}
+	e.Conn = msgconn.New(pc.LocalAddr(), pc.RemoteAddr(), e.send, func() error {
+		e.fin()
+		return pc.Close()
+	})
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := pc.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			h, err := unmarshalHeader(buf[:n])
+			if err != nil || h.Conn != e.id {
+				continue
+			}
+			e.handle(h, append([]byte(nil), buf[headerLen:n]...))
+		}
+	}()
+	return e, nil
+}
+
+// handshake sends SYN until the server answers with a SYN|ACK proving it
+// knows the key, then completes the connection with an ACK.
+func handshake(ctx context.Context, pc net.Conn, opts Options) (*endpoint, error) {
+	psk := opts.Key
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	isn := binary.BigEndian.Uint32(nonce)
+	syn := packet(hdr{Ver: version, Flags: FlagSYN, Win: window, Seq: isn}, append(nonce, proof(psk, nonce)...))
+
+	buf := make([]byte, 2048)
+	for wait := rtoMin * 2; ; wait = min(2*wait, rtoMax) {
+		if _, err := pc.Write(syn); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(wait)
+		if d, _ := ctx.Deadline(); d.Before(deadline) {
+			deadline = d
+		}
+		pc.SetReadDeadline(deadline)
+		for {
+			n, err := pc.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			h, err := unmarshalHeader(buf[:n])
+			if err != nil || h.Flags&(FlagSYN|FlagACK) != FlagSYN|FlagACK || h.Ack != isn {
+				if err == nil && h.Flags&FlagFIN != 0 && h.Ack == isn {
+					return nil, errors.New("rejected by server (wrong key?)")
+				}
+				continue
+			}
+			var seq [4]byte
+			binary.BigEndian.PutUint32(seq[:], h.Seq)
+			if !hmac.Equal(buf[headerLen:n], proof(psk, nonce, seq[:]...)) {
+				return nil, errors.New("server failed to prove the key")
+			}
+			pc.SetReadDeadline(time.Time{})
+			ack := marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: h.Conn, Win: window, Seq: isn, Ack: h.Seq})
+			if _, err := pc.Write(ack); err != nil {
+				return nil, err
+			}
+			return newEndpoint(h.Conn, opts, isn, h.Seq, func(b []byte) error {
+				_, err := pc.Write(b)
+				return err
+			}), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
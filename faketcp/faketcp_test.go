@@ -0,0 +1,212 @@
+package faketcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("faketcp-test-key")
+
+func echoServer(t *testing.T, addr string, opts Options) net.Listener {
+	t.Helper()
+	l, err := Listen(addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 65536)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialEcho(t *testing.T) {
+	l := echoServer(t, "127.0.0.1:0", Options{Key: testKey})
+	testEcho(t, l.Addr().String(), Options{Key: testKey})
+}
+
+func testEcho(t *testing.T, addr string, opts Options) {
+	c, err := Dial(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, 65536)
+	for _, msg := range []string{"hello faketcp", "", string(make([]byte, 30000))} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("echo = %q, want %q", buf[:n], msg)
+		}
+	}
+
+	// nothing more is coming
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+}
+
+func TestDialWrongKey(t *testing.T) {
+	l := echoServer(t, "127.0.0.1:0", Options{Key: testKey})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := Dial(ctx, l.Addr().String(), Options{Key: []byte("another-test-key")}); err == nil {
+		t.Fatal("handshake with the wrong key succeeded")
+	}
+}
+
+func TestCloseSendsFIN(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", Options{Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := Dial(context.Background(), l.Addr().String(), Options{Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := s.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("read after peer close: %v, want EOF", err)
+	}
+}
+
+func TestRawEcho(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw sockets")
+	}
+	addr := freeTCPAddr(t)
+	opts := Options{Key: testKey, Raw: true}
+	echoServer(t, addr, opts)
+	testEcho(t, addr, opts)
+}
+
+// TestRawErrors checks raw mode fails cleanly where it can't open its
+// socket: without privileges, on an address the host doesn't have, and
+// toward no IPv4 address.
+func TestRawErrors(t *testing.T) {
+	opts := Options{Key: testKey, Raw: true}
+	if os.Geteuid() != 0 {
+		if l, err := Listen(freeTCPAddr(t), opts); err == nil {
+			l.Close()
+			t.Fatal("Listen without privileges: no error")
+		}
+		if c, err := Dial(context.Background(), freeTCPAddr(t), opts); err == nil {
+			c.Close()
+			t.Fatal("Dial without privileges: no error")
+		}
+	}
+	// 192.0.2.0/24 is reserved for documentation
+	if l, err := Listen("192.0.2.1:4000", opts); err == nil {
+		l.Close()
+		t.Fatal("Listen on a foreign address: no error")
+	}
+	if c, err := Dial(context.Background(), ":4000", opts); err == nil {
+		c.Close()
+		t.Fatal("Dial to no address: no error")
+	}
+}
+
+// TestRawSegments watches the wire and checks the handshake goes out as
+// SYN, SYN|ACK, ACK in genuine TCP segments.
+func TestRawSegments(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw sockets")
+	}
+	sniff, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sniff.Close()
+	addr := freeTCPAddr(t)
+	port := addr[len("127.0.0.1:"):]
+	opts := Options{Key: testKey, Raw: true}
+	echoServer(t, addr, opts)
+	c, err := Dial(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type segment struct {
+		flags    uint8
+		seq, ack uint32
+		len      int
+	}
+	var got []segment
+	buf := make([]byte, 65536)
+	sniff.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(got) < 3 {
+		n, _, err := sniff.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("saw %+v, then: %v", got, err)
+		}
+		seg := buf[:n]
+		if p := fmt.Sprint(binary.BigEndian.Uint16(seg[0:2])); p != port && fmt.Sprint(binary.BigEndian.Uint16(seg[2:4])) != port {
+			continue
+		}
+		if seg[13]&tcpRST != 0 {
+			// the kernel's answer to a flow it does not know
+			continue
+		}
+		lo := net.IPv4(127, 0, 0, 1)
+		if tcpChecksum(lo, lo, seg) != 0 {
+			t.Fatalf("bad checksum in %x", seg)
+		}
+		got = append(got, segment{seg[13], binary.BigEndian.Uint32(seg[4:8]), binary.BigEndian.Uint32(seg[8:12]), n - tcpHeaderLen})
+	}
+	syn, synAck, ack := got[0], got[1], got[2]
+	if syn.flags != tcpSYN || synAck.flags != tcpSYN|tcpACK || ack.flags != tcpACK {
+		t.Fatalf("flags %#x %#x %#x, want SYN, SYN|ACK, ACK", syn.flags, synAck.flags, ack.flags)
+	}
+	if synAck.ack != syn.seq+1+uint32(syn.len) || ack.seq != synAck.ack || ack.ack != synAck.seq+1+uint32(synAck.len) {
+		t.Fatalf("sequence numbers do not follow: %+v", got)
+	}
+}
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
@@ -0,0 +1,64 @@
+// Package faketcp carries messages over UDP datagrams dressed as a TCP
+// flow: a SYN, SYN|ACK, ACK handshake authenticated with a pre-shared key,
+// then PSH segments that are acknowledged and retransmitted one at a time.
+// Payloads are sealed with AES-GCM under the same key. In Raw mode the
+// segments travel inside genuine TCP segments instead of UDP datagrams.
+package faketcp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	FlagSYN = 1 << 0
+	FlagACK = 1 << 1
+	FlagFIN = 1 << 2
+	FlagPSH = 1 << 3
+)
+
+const (
+	version   = 1
+	headerLen = 14
+	nonceLen  = 12
+	hmacLen   = 32 // SHA256
+	window    = 1024
+)
+
+type hdr struct {
+	Ver   uint8
+	Flags uint8
+	Conn  uint16
+	Win   uint16
+	Seq   uint32
+	Ack   uint32
+}
+
+func marshalHeader(h hdr) []byte {
+	b := make([]byte, headerLen)
+	b[0] = h.Ver
+	b[1] = h.Flags
+	binary.BigEndian.PutUint16(b[2:4], h.Conn)
+	binary.BigEndian.PutUint16(b[4:6], h.Win)
+	binary.BigEndian.PutUint32(b[6:10], h.Seq)
+	binary.BigEndian.PutUint32(b[10:14], h.Ack)
+	return b
+}
+
+func unmarshalHeader(b []byte) (hdr, error) {
+	var h hdr
+	if len(b) < headerLen {
+		return h, fmt.Errorf("short header")
+	}
+	h.Ver = b[0]
+	h.Flags = b[1]
+	h.Conn = binary.BigEndian.Uint16(b[2:4])
+	h.Win = binary.BigEndian.Uint16(b[4:6])
+	h.Seq = binary.BigEndian.Uint32(b[6:10])
+	h.Ack = binary.BigEndian.Uint32(b[10:14])
+	return h, nil
+}
+
+func packet(h hdr, payload []byte) []byte {
+	return append(marshalHeader(h), payload...)
+}
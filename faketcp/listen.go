@@ -0,0 +1,211 @@
+package faketcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+)
+
+// Listener accepts faketcp connections on a UDP socket, or a raw socket in
+// Raw mode.
+type Listener struct {
+	pc   net.PacketConn
+	opts Options
+
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	conns  map[string]*serverConn
+	nextID uint16
+}
+
+type serverConn struct {
+	*endpoint
+	isn uint32 // client SYN sequence number, to spot retransmitted SYNs
+	// synAck is resent when the client retransmits its SYN
+	synAck []byte
+}
+
+// Listen accepts faketcp connections on the UDP address addr, or the TCP
+// port of addr in Raw mode, from clients that know opts.Key. The returned
+// net.Listener is a *Listener.
+func Listen(addr string, opts Options) (net.Listener, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	var pc net.PacketConn
+	if opts.Raw {
+		laddr, err := net.ResolveTCPAddr("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := listenRaw(laddr)
+		if err != nil {
+			return nil, err
+		}
+		pc = rc
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l := &Listener{
+		pc:     pc,
+		opts:   opts,
+		accept: make(chan net.Conn, opts.Backlog),
+		done:   make(chan struct{}),
+		conns:  make(map[string]*serverConn),
+		nextID: 0x1000,
+	}
+	go l.run()
+	go l.expire()
+	return l, nil
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes every connection.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		conns := l.conns
+		l.conns = make(map[string]*serverConn)
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		err = l.pc.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+func (l *Listener) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := l.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		h, err := unmarshalHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		payload := append([]byte(nil), buf[headerLen:n]...)
+		if h.Flags&FlagSYN != 0 {
+			l.syn(raddr, h, payload)
+			continue
+		}
+		l.mu.Lock()
+		c, ok := l.conns[raddr.String()]
+		l.mu.Unlock()
+		if ok && h.Conn == c.id {
+			c.handle(h, payload)
+		}
+	}
+}
+
+// syn answers a connection request, starting a new connection unless it
+// is a retransmission of the SYN of the current one from raddr.
+func (l *Listener) syn(raddr net.Addr, h hdr, payload []byte) {
+	key := raddr.String()
+	if len(payload) < nonceLen+hmacLen || !hmac.Equal(payload[nonceLen:nonceLen+hmacLen], proof(l.opts.Key, payload[:nonceLen])) {
+		fin := hdr{Ver: version, Flags: FlagFIN | FlagACK, Ack: h.Seq}
+		l.pc.WriteTo(marshalHeader(fin), raddr)
+		return
+	}
+
+	l.mu.Lock()
+	old, ok := l.conns[key]
+	if ok && old.isn == h.Seq {
+		l.mu.Unlock()
+		l.pc.WriteTo(old.synAck, raddr)
+		return
+	}
+	id := l.nextID
+	l.nextID++
+	l.mu.Unlock()
+	if ok {
+		// the client restarted; its old connection is gone
+		old.CloseWithError(net.ErrClosed)
+	}
+
+	var b [4]byte
+	rand.Read(b[:])
+	isn := binary.BigEndian.Uint32(b[:])
+	c := &serverConn{
+		endpoint: newEndpoint(id, l.opts, isn, h.Seq, func(pkt []byte) error {
+			_, err := l.pc.WriteTo(pkt, raddr)
+			return err
+		}),
+		isn:    h.Seq,
+		synAck: packet(hdr{Ver: version, Flags: FlagSYN | FlagACK, Conn: id, Win: window, Seq: isn, Ack: h.Seq}, proof(l.opts.Key, payload[:nonceLen], b[:]...)),
+	}
+	c.Conn = msgconn.New(l.pc.LocalAddr(), raddr, c.send, func() error {
+		l.mu.Lock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		l.mu.Unlock()
+		c.fin()
+		return nil
+	})
+
+	select {
+	case l.accept <- c:
+	default:
+		// backlog full: drop the SYN, the client retries
+		return
+	}
+	l.mu.Lock()
+	l.conns[key] = c
+	l.mu.Unlock()
+	l.pc.WriteTo(c.synAck, raddr)
+}
+
+func (l *Listener) expire() {
+	tick := time.NewTicker(l.opts.IdleTimeout / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			l.mu.Lock()
+			var idle []*serverConn
+			for _, c := range l.conns {
+				if c.idle(now) > l.opts.IdleTimeout {
+					idle = append(idle, c)
+				}
+			}
+			l.mu.Unlock()
+			for _, c := range idle {
+				c.Close()
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
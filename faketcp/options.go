@@ -0,0 +1,49 @@
+package faketcp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options configures Dial and Listen. Only Key is required.
+type Options struct {
+	// Key authenticates the handshake and seals payloads with AES-GCM; it
+	// must be 16, 24 or 32 bytes.
+	Key []byte
+	// HandshakeTimeout bounds Dial when its context has no deadline.
+	// Default 5s.
+	HandshakeTimeout time.Duration
+	// Retries is how many times a segment is sent before Write gives up.
+	// Default 6.
+	Retries int
+	// IdleTimeout closes server connections that received nothing for
+	// that long. Default 5m.
+	IdleTimeout time.Duration
+	// Raw sends genuine TCP segments on a raw IPv4 socket instead of UDP
+	// datagrams, for networks that only let TCP through. It needs root or
+	// CAP_NET_RAW on both ends.
+	Raw bool
+	// Backlog bounds the connections waiting for Accept. Default 64.
+	Backlog int
+}
+
+func (o Options) withDefaults() (Options, error) {
+	switch len(o.Key) {
+	case 16, 24, 32:
+	default:
+		return o, fmt.Errorf("faketcp: key must be 16, 24 or 32 bytes, got %d", len(o.Key))
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = 5 * time.Second
+	}
+	if o.Retries <= 0 {
+		o.Retries = 6
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+	if o.Backlog <= 0 {
+		o.Backlog = 64
+	}
+	return o, nil
+}
@@ -0,0 +1,311 @@
+package faketcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TCP header flags, as on the wire.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+const (
+	tcpHeaderLen = 20
+	tcpWindow    = 64240
+	// rawFlowIdle forgets the sequence state of peers silent that long.
+	rawFlowIdle = 10 * time.Minute
+)
+
+// rawConn carries faketcp segments as the payload of genuine TCP segments
+// on a raw IPv4 socket, for networks that drop anything but TCP. Towards
+// each peer it keeps the sequence and acknowledgment numbers of a real
+// flow: the handshake segments go out as SYN, SYN|ACK and ACK, data as
+// PSH|ACK, each numbered by the bytes sent before it.
+//
+// The kernel knows nothing of these flows and answers them with RSTs,
+// which rawConn ignores; drop outgoing RSTs on the port with a firewall
+// rule if a middlebox on the path acts on them.
+//
+// A dialed rawConn is a net.Conn to its peer; a listening one is a
+// net.PacketConn. Both use *net.TCPAddr addresses.
+type rawConn struct {
+	ip    *net.IPConn
+	local *net.TCPAddr
+	// peer is the server of a dialed rawConn, nil when listening
+	peer *net.TCPAddr
+
+	mu    sync.Mutex
+	flows map[string]*rawFlow
+	// srcs caches the local address used towards each peer IP
+	srcs map[string]net.IP
+	buf  [65536]byte
+}
+
+// rawFlow is the outer TCP state towards one peer.
+type rawFlow struct {
+	isn uint32
+	// seq is the next sequence number to send, ack the next one expected
+	seq, ack uint32
+	synced   bool
+	lastSeen time.Time
+}
+
+func listenRaw(laddr *net.TCPAddr) (*rawConn, error) {
+	if laddr.IP != nil && laddr.IP.To4() == nil {
+		return nil, errors.New("faketcp: raw mode is IPv4 only")
+	}
+	ip, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: laddr.IP})
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{
+		ip:    ip,
+		local: laddr,
+		flows: make(map[string]*rawFlow),
+		srcs:  make(map[string]net.IP),
+	}, nil
+}
+
+// dialRaw returns a rawConn to raddr on a free local port.
+func dialRaw(raddr *net.TCPAddr) (*rawConn, error) {
+	if raddr.IP.To4() == nil {
+		return nil, errors.New("faketcp: raw mode is IPv4 only")
+	}
+	// borrow a port the kernel considers free
+	ln, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	r, err := listenRaw(&net.TCPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	r.peer = raddr
+	return r, nil
+}
+
+// ReadFrom returns the payload of the next TCP segment addressed to the
+// local port, skipping RSTs and segments without payload.
+func (r *rawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := r.ip.ReadFrom(r.buf[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		seg := r.buf[:n]
+		if n < tcpHeaderLen || int(binary.BigEndian.Uint16(seg[2:4])) != r.local.Port {
+			continue
+		}
+		off := int(seg[12]>>4) * 4
+		flags := seg[13]
+		if off < tcpHeaderLen || off > n || flags&tcpRST != 0 {
+			continue
+		}
+		raddr := &net.TCPAddr{IP: from.(*net.IPAddr).IP, Port: int(binary.BigEndian.Uint16(seg[0:2]))}
+		if r.peer != nil && (!raddr.IP.Equal(r.peer.IP) || raddr.Port != r.peer.Port) {
+			continue
+		}
+		payload := seg[off:]
+		if len(payload) == 0 {
+			continue
+		}
+		r.received(raddr, binary.BigEndian.Uint32(seg[4:8]), flags, len(payload))
+		return copy(b, payload), raddr, nil
+	}
+}
+
+// received advances the acknowledgment number towards raddr past a
+// segment from it.
+func (r *rawConn) received(raddr *net.TCPAddr, seq uint32, flags uint8, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	key := raddr.String()
+	f := r.flows[key]
+	if flags&tcpSYN != 0 {
+		if f == nil || f.synced && f.ack != seq+1+uint32(n) {
+			// a new flow, or the peer restarted
+			r.prune(now)
+			f = r.flow(key, now)
+		}
+		f.ack, f.synced, f.lastSeen = seq+1+uint32(n), true, now
+		return
+	}
+	if f == nil {
+		f = r.flow(key, now)
+	}
+	f.lastSeen = now
+	end := seq + uint32(n)
+	if flags&tcpFIN != 0 {
+		end++
+	}
+	if !f.synced || int32(end-f.ack) > 0 {
+		f.ack, f.synced = end, true
+	}
+}
+
+// flow starts the outer state towards key. r.mu must be held.
+func (r *rawConn) flow(key string, now time.Time) *rawFlow {
+	var b [4]byte
+	rand.Read(b[:])
+	isn := binary.BigEndian.Uint32(b[:])
+	f := &rawFlow{isn: isn, seq: isn, lastSeen: now}
+	r.flows[key] = f
+	return f
+}
+
+// prune forgets idle flows. r.mu must be held.
+func (r *rawConn) prune(now time.Time) {
+	for key, f := range r.flows {
+		if now.Sub(f.lastSeen) > rawFlowIdle {
+			delete(r.flows, key)
+		}
+	}
+}
+
+// WriteTo sends the faketcp segment b to addr in a TCP segment whose flags
+// follow the ones of b.
+func (r *rawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	raddr, ok := addr.(*net.TCPAddr)
+	if !ok || raddr.IP.To4() == nil {
+		return 0, errors.New("faketcp: raw mode needs an IPv4 TCP address")
+	}
+	src, err := r.source(raddr.IP)
+	if err != nil {
+		return 0, err
+	}
+	var inner uint8
+	if len(b) > 1 {
+		inner = b[1]
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	f := r.flows[raddr.String()]
+	if f == nil {
+		f = r.flow(raddr.String(), now)
+	}
+	f.lastSeen = now
+	var flags uint8
+	seq := f.seq
+	switch {
+	case inner&FlagSYN != 0:
+		// a retransmitted SYN goes out with the same number
+		flags, seq = tcpSYN, f.isn
+		f.seq = f.isn + 1 + uint32(len(b))
+	case inner&FlagFIN != 0:
+		flags = tcpFIN
+		f.seq += uint32(len(b)) + 1
+	case inner&FlagPSH != 0:
+		flags = tcpPSH
+		f.seq += uint32(len(b))
+	default:
+		f.seq += uint32(len(b))
+	}
+	var ack uint32
+	if f.synced {
+		flags |= tcpACK
+		ack = f.ack
+	}
+	r.mu.Unlock()
+
+	seg := tcpSegment(src, raddr.IP, uint16(r.local.Port), uint16(raddr.Port), seq, ack, flags, b)
+	if _, err := r.ip.WriteTo(seg, &net.IPAddr{IP: raddr.IP}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// source returns the local address segments to dst leave from, which the
+// TCP checksum covers.
+func (r *rawConn) source(dst net.IP) (net.IP, error) {
+	if ip := r.local.IP; ip != nil && !ip.IsUnspecified() {
+		return ip.To4(), nil
+	}
+	r.mu.Lock()
+	src, ok := r.srcs[string(dst)]
+	r.mu.Unlock()
+	if ok {
+		return src, nil
+	}
+	// connecting a UDP socket picks the route without sending anything
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	src = c.LocalAddr().(*net.UDPAddr).IP.To4()
+	c.Close()
+	r.mu.Lock()
+	r.srcs[string(dst)] = src
+	r.mu.Unlock()
+	return src, nil
+}
+
+func (r *rawConn) Read(b []byte) (int, error) {
+	n, _, err := r.ReadFrom(b)
+	return n, err
+}
+
+func (r *rawConn) Write(b []byte) (int, error) {
+	if r.peer == nil {
+		return 0, os.ErrInvalid
+	}
+	return r.WriteTo(b, r.peer)
+}
+
+func (r *rawConn) Close() error                       { return r.ip.Close() }
+func (r *rawConn) LocalAddr() net.Addr                { return r.local }
+func (r *rawConn) RemoteAddr() net.Addr               { return r.peer }
+func (r *rawConn) SetDeadline(t time.Time) error      { return r.ip.SetDeadline(t) }
+func (r *rawConn) SetReadDeadline(t time.Time) error  { return r.ip.SetReadDeadline(t) }
+func (r *rawConn) SetWriteDeadline(t time.Time) error { return r.ip.SetWriteDeadline(t) }
+
+// tcpSegment builds a TCP segment without options from src to dst.
+func tcpSegment(src, dst net.IP, sport, dport uint16, seq, ack uint32, flags uint8, payload []byte) []byte {
+	b := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], sport)
+	binary.BigEndian.PutUint16(b[2:4], dport)
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = tcpHeaderLen / 4 << 4
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:16], tcpWindow)
+	copy(b[tcpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(b[16:18], tcpChecksum(src, dst, b))
+	return b
+}
+
+// tcpChecksum is the Internet checksum of seg behind the IPv4 pseudo
+// header.
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To4())
+	add(dst.To4())
+	sum += 6 // protocol
+	sum += uint32(len(seg))
+	add(seg)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,167 @@
+package faketcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	codec "icmp-tunnel/pkg"
+)
+
+func readPacketWithTimeout(conn *net.UDPConn, timeout time.Duration) (hdr, []byte, error) {
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return hdr{}, nil, err
+	}
+	h, err := unmarshalHeader(buf[:n])
+	return h, append([]byte(nil), buf[headerLen:n]...), err
+}
+
+func rawClient(t *testing.T, l net.Listener) *net.UDPConn {
+	t.Helper()
+	c, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServerHandshakeAndEcho(t *testing.T) {
+	l := echoServer(t, "127.0.0.1:0", Options{Key: testKey})
+	c := rawClient(t, l)
+
+	nonce := make([]byte, nonceLen)
+	rand.Read(nonce)
+	isn := uint32(12345)
+	c.Write(packet(hdr{Ver: version, Flags: FlagSYN, Win: window, Seq: isn}, append(nonce, proof(testKey, nonce)...)))
+
+	synAck, payload, err := readPacketWithTimeout(c, 2*time.Second)
+	if err != nil {
+		t.Fatalf("waiting for SYN|ACK: %v", err)
+	}
+	if synAck.Flags != FlagSYN|FlagACK || synAck.Ack != isn {
+		t.Fatalf("got flags=0x%02x ack=%d, want SYN|ACK of %d", synAck.Flags, synAck.Ack, isn)
+	}
+	var seq [4]byte
+	binary.BigEndian.PutUint32(seq[:], synAck.Seq)
+	if !bytes.Equal(payload, proof(testKey, nonce, seq[:]...)) {
+		t.Fatal("SYN|ACK does not prove the key")
+	}
+	c.Write(marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: synAck.Conn, Win: window, Seq: isn, Ack: synAck.Seq}))
+
+	for i := uint32(1); i <= 3; i++ {
+		msg := []byte("hello faketcp from test")
+		sealed, _ := codec.EncryptAES(testKey, msg)
+		c.Write(packet(hdr{Ver: version, Flags: FlagPSH, Conn: synAck.Conn, Win: window, Seq: isn + i}, sealed))
+
+		// the ACK and the echo may arrive in either order
+		var acked, echoed bool
+		for !acked || !echoed {
+			h, payload, err := readPacketWithTimeout(c, 2*time.Second)
+			if err != nil {
+				t.Fatalf("segment %d: %v (acked %v, echoed %v)", i, err, acked, echoed)
+			}
+			switch {
+			case h.Flags == FlagACK && h.Ack == isn+i:
+				acked = true
+			case h.Flags == FlagPSH && h.Seq == synAck.Seq+i:
+				got, err := codec.DecryptAES(testKey, payload)
+				if err != nil || !bytes.Equal(got, msg) {
+					t.Fatalf("echo = %q, %v", got, err)
+				}
+				echoed = true
+				c.Write(marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: synAck.Conn, Win: window, Ack: h.Seq}))
+			}
+		}
+	}
+}
+
+func TestServerHandshakeWithBadCode(t *testing.T) {
+	l := echoServer(t, "127.0.0.1:0", Options{Key: testKey})
+	c := rawClient(t, l)
+
+	nonce := make([]byte, nonceLen)
+	rand.Read(nonce)
+	c.Write(packet(hdr{Ver: version, Flags: FlagSYN, Win: window, Seq: 12345}, append(nonce, proof([]byte("supersecretkey125"), nonce)...)))
+
+	h, _, err := readPacketWithTimeout(c, 2*time.Second)
+	if err != nil {
+		t.Fatalf("waiting for reply: %v", err)
+	}
+	if h.Flags != FlagFIN|FlagACK || h.Conn != 0 {
+		t.Fatalf("expected FIN|ACK without a connection, got flags=0x%02x conn=%d", h.Flags, h.Conn)
+	}
+}
+
+// runMockServer answers like a faketcp server, dropping the first copy of
+// every data segment to exercise retransmission.
+func runMockServer(t *testing.T) string {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		seen := make(map[uint32]bool)
+		for {
+			n, raddr, err := sock.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			h, err := unmarshalHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			switch {
+			case h.Flags&FlagSYN != 0:
+				var serverSeq [4]byte
+				binary.BigEndian.PutUint32(serverSeq[:], 9999)
+				resp := hdr{Ver: version, Flags: FlagSYN | FlagACK, Conn: 0x1000, Win: window, Seq: 9999, Ack: h.Seq}
+				sock.WriteToUDP(packet(resp, proof(testKey, buf[headerLen:headerLen+nonceLen], serverSeq[:]...)), raddr)
+			case h.Flags&FlagPSH != 0:
+				if !seen[h.Seq] {
+					seen[h.Seq] = true
+					continue
+				}
+				sock.WriteToUDP(marshalHeader(hdr{Ver: version, Flags: FlagACK, Conn: h.Conn, Win: window, Ack: h.Seq}), raddr)
+				// the server's segments count up from its SYN|ACK
+				echo := hdr{Ver: version, Flags: FlagPSH, Conn: h.Conn, Win: window, Seq: 9999 + uint32(len(seen))}
+				sock.WriteToUDP(packet(echo, buf[headerLen:n]), raddr)
+			}
+		}
+	}()
+	return sock.LocalAddr().String()
+}
+
+func TestHandshakeAndSendReliable(t *testing.T) {
+	addr := runMockServer(t)
+	c, err := Dial(context.Background(), addr, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, 65536)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write([]byte("test-message")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read echo failed: %v", err)
+		}
+		if string(buf[:n]) != "test-message" {
+			t.Fatalf("echo payload mismatch: got %q", buf[:n])
+		}
+	}
+}
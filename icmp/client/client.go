@@ -1,41 +1,48 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	codec "icmp-tunnel/pkg"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
-func Client(serverIP string, localUDP string) (net.PacketConn, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", localUDP)
-	if err != nil {
-		return nil, err
-	}
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return nil, err
-	}
-	defer udpConn.Close()
+// lastSeq numbers SendData calls so late replies to an earlier request are
+// never mistaken for the answer to the current one: the server numbers the
+// first reply after a request like the request.
+var lastSeq atomic.Uint32
 
-	icmpConn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+// Client opens the ICMP socket SendData reads the replies of the IPv4
+// host serverIP from. To forward a local UDP port through the tunnel, use
+// ListenProxy.
+func Client(serverIP string) (net.PacketConn, error) {
+	ip, err := net.ResolveIPAddr("ip4", serverIP)
 	if err != nil {
 		return nil, err
 	}
-	return icmpConn, nil
+	if ip.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", serverIP)
+	}
+	return net.ListenPacket("ip4:icmp", "0.0.0.0")
 }
 
-func SendData(con net.PacketConn, serverIP string, data []byte) ([]byte, error) {
+// SendData sends one request sealed with secretKey to the server and waits
+// for its reply. Calls sharing con must not run concurrently.
+func SendData(con net.PacketConn, serverIP string, secretKey, data []byte) ([]byte, error) {
 	// defer con.Close()
-	var secretKey = []byte("0123456789abcdef")
 	data, err := codec.EncryptAES(secretKey, data)
 	if err != nil {
 		return nil, err
 	}
 
 	session := uint16(os.Getpid() & 0xffff)
-	seq := uint16(1)
+	seq := uint16(lastSeq.Add(1)) % codec.ServerSeqBase
+	if seq == 0 {
+		seq = uint16(lastSeq.Add(1)) % codec.ServerSeqBase // 0 is for polls
+	}
 	frags, err := codec.SimpleFragment(session, seq, data, 1400)
 	if err != nil {
 		return nil, err
@@ -43,7 +50,20 @@ func SendData(con net.PacketConn, serverIP string, data []byte) ([]byte, error)
 
 	icmpID := session
 	icmpSeq := seq
+	// the server sends one reply per request, so polls go along for a
+	// reply of a few fragments
+	for range 4 {
+		poll, err := codec.EncryptAES(secretKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		frags = append(frags, codec.BuildFragmentPayload(session, 0, 0, 1, poll))
+	}
+
+	// a host that answers pings itself mirrors our fragments back as replies
+	sent := make(map[string]bool, len(frags))
 	for _, frag := range frags {
+		sent[string(frag)] = true
 		pkt := codec.BuildICMPEcho(8, 0, icmpID, icmpSeq, frag)
 		sendConn, err := net.Dial("ip4:icmp", serverIP)
 		if err != nil {
@@ -54,34 +74,35 @@ func SendData(con net.PacketConn, serverIP string, data []byte) ([]byte, error)
 	}
 
 	reasm := codec.NewReassembler(5 * time.Second)
-	timeout := time.After(3 * time.Second)
+	con.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer con.SetReadDeadline(time.Time{})
 	buf := make([]byte, 65535)
 
 	for {
-		select {
-		case <-timeout:
-			return nil, fmt.Errorf("timeout waiting for response")
-		default:
-			n, _, err := con.ReadFrom(buf)
-			if err != nil {
-				continue
-			}
-			typ, _, _, _, payload, err := codec.ParseICMPEcho(buf[:n])
-			if err != nil || typ != 0 {
-				continue
-			}
-			sess, s, idx, total, data, err := codec.ParseFragmentPayload(payload)
-			if err != nil || sess != session || s != seq {
-				continue
+		n, _, err := con.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, fmt.Errorf("timeout waiting for response")
 			}
-			complete, assembled, err := reasm.AddFragment(sess, s, idx, total, data)
-			if err == nil && complete {
-				assembled, err = codec.DecryptAES(secretKey, assembled)
-				if err != nil {
-					return nil, err
-				}
-				return assembled, nil
+			continue
+		}
+		typ, _, _, _, payload, err := codec.ParseICMPEcho(buf[:n])
+		if err != nil || typ != 0 || sent[string(payload)] {
+			continue
+		}
+		sess, s, idx, total, data, err := codec.ParseFragmentPayload(payload)
+		if err != nil || sess != session || s != seq {
+			continue
+		}
+		data = append([]byte(nil), data...)
+		complete, assembled, err := reasm.AddFragment(sess, s, idx, total, data)
+		if err == nil && complete {
+			assembled, err = codec.DecryptAES(secretKey, assembled)
+			if err != nil {
+				return nil, err
 			}
+			return assembled, nil
 		}
 	}
 }
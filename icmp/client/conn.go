@@ -0,0 +1,289 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// fragmentSize is the most message bytes one echo request carries.
+const fragmentSize = 1400
+
+// The client polls pollMin after traffic either way, backing off to pollMax
+// while there is none; pollMax stays below the time the server takes a
+// request to be stale, so it can always push.
+const (
+	pollMin = 50 * time.Millisecond
+	pollMax = 2 * time.Second
+)
+
+// The server answers every request at most once and only for a while,
+// creditLife as the client counts it, so the client keeps requests
+// outstanding for the replies it expects: preissue after writing a
+// message, one more for every reply while they flow, up to maxWindow.
+const (
+	creditLife = 3 * time.Second
+	preissue   = 4
+	maxWindow  = 64
+)
+
+// Conn is a long-lived tunnel to one ICMP server. Every Write is sealed,
+// fragmented and sent as echo requests; every echo reply the server sends
+// back is reassembled and returned by one Read. Deadlines apply as for any
+// net.Conn.
+//
+// As the server can only answer requests, one reply to each, Conn polls
+// it with small sealed requests of fragment sequence 0, which messages
+// never take.
+type Conn struct {
+	*msgconn.Conn
+	pc      net.PacketConn
+	server  *net.IPAddr
+	key     []byte
+	session uint16
+	// local is the source address over IPv6, for the ICMPv6 checksum; nil
+	// over IPv4
+	local net.IP
+
+	mu sync.Mutex
+	// seq numbers messages, icmpSeq every echo request
+	seq, icmpSeq uint16
+	// sent remembers recent fragments: a server host that answers pings
+	// itself mirrors them back as replies
+	sent map[string]time.Time
+	// credits holds when the requests the server may still answer went
+	// out, oldest first; window is how many to keep
+	credits []time.Time
+	window  int
+
+	// kick brings polling back to its fastest rate
+	kick chan struct{}
+}
+
+// Dial opens a tunnel to the ICMP server at host, sealing messages with
+// secretKey. The tunnel runs over ICMPv6 if host is an IPv6 address.
+func Dial(host string, secretKey []byte) (*Conn, error) {
+	server, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var local net.IP
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	if server.IP.To4() == nil {
+		network, laddr = "ip6:ipv6-icmp", "::"
+		if local, err = codec.SourceIP(server.IP); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	rand.Read(b[:])
+	c := &Conn{
+		pc:      pc,
+		server:  server,
+		key:     secretKey,
+		session: binary.BigEndian.Uint16(b[:]),
+		local:   local,
+		sent:    make(map[string]time.Time),
+		window:  preissue,
+		kick:    make(chan struct{}, 1),
+	}
+	c.Conn = msgconn.New(pc.LocalAddr(), server, c.send, pc.Close)
+	go c.readLoop()
+	go c.pollLoop()
+	return c, nil
+}
+
+// Session returns the ID the server tells this tunnel apart by.
+func (c *Conn) Session() uint16 { return c.session }
+
+func (c *Conn) send(msg []byte) error {
+	sealed, err := codec.EncryptAES(c.key, msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.seq++; c.seq >= codec.ServerSeqBase {
+		c.seq = 1 // 0 is for polls
+	}
+	frags, err := codec.SimpleFragment(c.session, c.seq, sealed, fragmentSize)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, frag := range frags {
+		if err := c.sendFragment(frag); err != nil {
+			return err
+		}
+	}
+	// a reply may follow
+	c.poke()
+	return c.topUp(0)
+}
+
+// sendFragment sends frag in an echo request, remembering it to tell the
+// mirrored reply of a pinged host apart.
+func (c *Conn) sendFragment(frag []byte) error {
+	now := time.Now()
+	c.mu.Lock()
+	for k, t := range c.sent {
+		if now.Sub(t) > 10*time.Second {
+			delete(c.sent, k)
+		}
+	}
+	c.sent[string(frag)] = now
+	c.pruneCredits(now)
+	if len(c.credits) < 2*maxWindow {
+		c.credits = append(c.credits, now)
+	}
+	c.icmpSeq++
+	pkt := c.request(c.icmpSeq, frag)
+	c.mu.Unlock()
+	_, err := c.pc.WriteTo(pkt, c.server)
+	return err
+}
+
+// request builds the echo request carrying frag.
+func (c *Conn) request(seq uint16, frag []byte) []byte {
+	if c.local != nil {
+		return codec.BuildICMPv6Echo(codec.ICMPv6EchoRequest, 0, c.session, seq, frag, c.local, c.server.IP)
+	}
+	return codec.BuildICMPEcho(codec.ICMPEchoRequest, 0, c.session, seq, frag)
+}
+
+// poll sends the server a request to answer with what it has queued.
+func (c *Conn) poll() error {
+	sealed, err := codec.EncryptAES(c.key, nil)
+	if err != nil {
+		return err
+	}
+	return c.sendFragment(codec.BuildFragmentPayload(c.session, 0, 0, 1, sealed))
+}
+
+// pruneCredits forgets the requests the server no longer answers. c.mu
+// must be held.
+func (c *Conn) pruneCredits(now time.Time) {
+	i := 0
+	for i < len(c.credits) && now.Sub(c.credits[i]) > creditLife {
+		i++
+	}
+	c.credits = c.credits[i:]
+}
+
+// topUp polls until the server holds as many requests as the window, or
+// want if that is more.
+func (c *Conn) topUp(want int) error {
+	c.mu.Lock()
+	c.pruneCredits(time.Now())
+	n := max(want, c.window) - len(c.credits)
+	c.mu.Unlock()
+	for range n {
+		if err := c.poll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replied counts a reply carrying fragment idx of total: it spent a
+// credit, and more may follow.
+func (c *Conn) replied(idx, total uint8) {
+	c.mu.Lock()
+	c.pruneCredits(time.Now())
+	if len(c.credits) > 0 {
+		c.credits = c.credits[1:]
+	}
+	c.window = min(c.window+1, maxWindow)
+	c.mu.Unlock()
+	c.topUp(int(total) - 1 - int(idx))
+}
+
+func (c *Conn) poke() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// pollLoop polls at pollMin while traffic flows, doubling the interval
+// after every poll to pollMax while it does not.
+func (c *Conn) pollLoop() {
+	delay := pollMin
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if err := c.poll(); errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay = min(2*delay, pollMax); delay == pollMax {
+				// idle: expect little again
+				c.mu.Lock()
+				c.window = preissue
+				c.mu.Unlock()
+			}
+		case <-c.kick:
+			delay = pollMin
+		case <-c.Done():
+			return
+		}
+		timer.Reset(delay)
+	}
+}
+
+func (c *Conn) readLoop() {
+	reply := uint8(codec.ICMPEchoReply)
+	if c.local != nil {
+		reply = codec.ICMPv6EchoReply
+	}
+	reasm := codec.NewReassembler(5 * time.Second)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if ip, ok := addr.(*net.IPAddr); !ok || !ip.IP.Equal(c.server.IP) {
+			continue
+		}
+		typ, _, _, _, payload, err := codec.ParseICMPEcho(buf[:n])
+		if err != nil || typ != reply {
+			continue
+		}
+		c.mu.Lock()
+		_, mirrored := c.sent[string(payload)]
+		c.mu.Unlock()
+		if mirrored {
+			continue
+		}
+		sess, seq, idx, total, data, err := codec.ParseFragmentPayload(payload)
+		if err != nil || sess != c.session {
+			continue
+		}
+		c.replied(idx, total)
+		data = append([]byte(nil), data...)
+		complete, assembled, err := reasm.AddFragment(sess, seq, idx, total, data)
+		if err != nil || !complete {
+			continue
+		}
+		msg, err := codec.DecryptAES(c.key, assembled)
+		if err != nil {
+			continue
+		}
+		c.poke()
+		c.Deliver(msg)
+	}
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyIdle closes the tunnel of a local peer that sent nothing and
+	// got nothing for that long.
+	proxyIdle = 2 * time.Minute
+	// maxPeers bounds the local peers forwarded at once; datagrams from
+	// more are dropped.
+	maxPeers = 256
+)
+
+// Proxy forwards a local UDP port through the tunnel. Every local peer
+// address gets a tunnel of its own, so the server gives it an upstream
+// socket of its own and every datagram coming back goes to the peer whose
+// traffic it answers.
+type Proxy struct {
+	pc     *net.UDPConn
+	server string
+	key    []byte
+	done   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	peers map[string]*proxyPeer
+}
+
+type proxyPeer struct {
+	addr     *net.UDPAddr
+	conn     *Conn
+	lastUsed time.Time // guarded by Proxy.mu
+}
+
+// ListenProxy listens on the UDP address localUDP and forwards every
+// datagram through a tunnel to the ICMP server at serverIP, sealed with
+// secretKey, until the Proxy is closed.
+func ListenProxy(serverIP, localUDP string, secretKey []byte) (*Proxy, error) {
+	// resolved once, so peers don't each look the name up
+	server, err := net.ResolveIPAddr("ip", serverIP)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", localUDP)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		pc:     pc,
+		server: server.String(),
+		key:    secretKey,
+		done:   make(chan struct{}),
+		peers:  make(map[string]*proxyPeer),
+	}
+	go p.readLoop()
+	go p.expireLoop()
+	return p, nil
+}
+
+// Addr returns the local UDP address.
+func (p *Proxy) Addr() net.Addr { return p.pc.LocalAddr() }
+
+// Close stops listening and closes the tunnel of every peer.
+func (p *Proxy) Close() error {
+	var err error
+	p.once.Do(func() {
+		close(p.done)
+		err = p.pc.Close()
+		p.mu.Lock()
+		peers := p.peers
+		p.peers = make(map[string]*proxyPeer)
+		p.mu.Unlock()
+		for _, peer := range peers {
+			peer.conn.Close()
+		}
+	})
+	return err
+}
+
+func (p *Proxy) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := p.pc.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		peer, err := p.peer(from)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("icmp proxy: %s: %v", from, err)
+			continue
+		}
+		if peer != nil {
+			peer.conn.Write(buf[:n])
+		}
+	}
+}
+
+// peer returns the peer at addr, dialing its tunnel if it has none. It
+// returns nil if there are too many.
+func (p *Proxy) peer(addr *net.UDPAddr) (*proxyPeer, error) {
+	key := addr.String()
+	p.mu.Lock()
+	if peer, ok := p.peers[key]; ok {
+		peer.lastUsed = time.Now()
+		p.mu.Unlock()
+		return peer, nil
+	}
+	full := len(p.peers) >= maxPeers
+	p.mu.Unlock()
+	if full {
+		return nil, nil
+	}
+
+	// setting the tunnel up must not hold up the other peers
+	conn, err := Dial(p.server, p.key)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		conn.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	if peer, ok := p.peers[key]; ok {
+		conn.Close()
+		peer.lastUsed = time.Now()
+		return peer, nil
+	}
+	if len(p.peers) >= maxPeers {
+		conn.Close()
+		return nil, nil
+	}
+	peer := &proxyPeer{addr: addr, conn: conn, lastUsed: time.Now()}
+	p.peers[key] = peer
+	go p.replyLoop(key, peer)
+	return peer, nil
+}
+
+// replyLoop sends what comes back through the tunnel of peer to it.
+func (p *Proxy) replyLoop(key string, peer *proxyPeer) {
+	defer func() {
+		p.mu.Lock()
+		if p.peers[key] == peer {
+			delete(p.peers, key)
+		}
+		p.mu.Unlock()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := peer.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		peer.lastUsed = time.Now()
+		p.mu.Unlock()
+		if _, err := p.pc.WriteToUDP(buf[:n], peer.addr); errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (p *Proxy) expireLoop() {
+	tick := time.NewTicker(proxyIdle / 4)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-p.done:
+			return
+		}
+		var idle []*proxyPeer
+		p.mu.Lock()
+		for _, peer := range p.peers {
+			if now.Sub(peer.lastUsed) > proxyIdle {
+				idle = append(idle, peer)
+			}
+		}
+		p.mu.Unlock()
+		for _, peer := range idle {
+			peer.conn.Close()
+		}
+	}
+}
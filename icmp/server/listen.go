@@ -0,0 +1,455 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+const (
+	// fragmentSize is the most message bytes one echo reply carries.
+	fragmentSize = 1400
+	// sessionIdle closes sessions that sent no request for that long.
+	sessionIdle = 5 * time.Minute
+	// requestFresh is how long a reply may go out against an echo
+	// request; after that firewalls and NATs may no longer pass it.
+	requestFresh = 3 * time.Second
+	// maxQueued bounds the reply fragments a session has waiting for a
+	// request; messages past it are dropped.
+	maxQueued = 512
+	// maxCredits bounds the unanswered requests a session keeps; older
+	// ones are forgotten.
+	maxCredits = 256
+	// maxEarly bounds the sources whose requests are counted before their
+	// session starts.
+	maxEarly = 1024
+	// reasmTimeout drops messages still incomplete after it, and the
+	// reassembler of a source that sent nothing for as long.
+	reasmTimeout = 5 * time.Second
+	// maxSources bounds the sources fragments are reassembled for.
+	maxSources = 256
+)
+
+// Listener accepts tunnel sessions from ICMP clients over IPv4 and ICMPv6.
+// A session is one client tunnel, told apart by source address and the
+// session ID in its fragments.
+type Listener struct {
+	socks []*socket
+	key   []byte
+
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	sessions map[sessionKey]*Session
+}
+
+// socket is the raw socket of one address family.
+type socket struct {
+	pc net.PacketConn
+	v6 bool
+}
+
+type sessionKey struct {
+	src string
+	id  uint16
+}
+
+// Session is the server side of one client tunnel. Read returns the
+// messages the client writes. As the client can only receive echo
+// replies, Write queues the message, which goes out in replies to the
+// client's requests.
+//
+// Many firewalls and NATs pass at most one reply per request, and rewrite
+// the ICMP identifier on the way, so a session is told apart by the
+// session ID in the fragments, and every request it sends is a credit for
+// one reply, carrying one fragment, spent within requestFresh.
+type Session struct {
+	*msgconn.Conn
+	l    *Listener
+	sock *socket
+	key  sessionKey
+	src  net.Addr
+	// local is the address the client reaches over IPv6, for the ICMPv6
+	// checksum
+	local net.IP
+
+	mu sync.Mutex
+	// credits are the unanswered requests, oldest first
+	credits  []credit
+	lastSeen time.Time
+	// seq numbers the messages to the client no request is waiting for
+	seq uint16
+	// answer is the sequence of the latest client message no reply has
+	// followed yet, 0 if none
+	answer uint16
+	queued [][]byte
+}
+
+// credit is an echo request a reply may go out against.
+type credit struct {
+	id, seq uint16
+	at      time.Time
+}
+
+// Listen answers echo requests carrying tunnel messages sealed with
+// secretKey, over IPv4 and over ICMPv6 where the host has IPv6.
+//
+// The kernel must not answer echo requests itself, or its replies spend
+// the credits of the sessions first: set net.ipv4.icmp_echo_ignore_all=1,
+// and net.ipv6.icmp.echo_ignore_all=1 for ICMPv6. Listen logs a warning
+// if it is not.
+func Listen(secretKey []byte) (*Listener, error) {
+	l := &Listener{
+		key:      secretKey,
+		accept:   make(chan net.Conn, 64),
+		done:     make(chan struct{}),
+		sessions: make(map[sessionKey]*Session),
+	}
+	var errs []error
+	for _, f := range []struct {
+		network, addr string
+	}{{"ip4:icmp", "0.0.0.0"}, {"ip6:ipv6-icmp", "::"}} {
+		pc, err := net.ListenPacket(f.network, f.addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		l.socks = append(l.socks, &socket{pc: pc, v6: f.addr == "::"})
+	}
+	if len(l.socks) == 0 {
+		return nil, fmt.Errorf("listen icmp failed: %v", errors.Join(errs...))
+	}
+	for _, sock := range l.socks {
+		warnKernelEcho(sock.v6)
+		go l.readLoop(sock)
+	}
+	go l.expire()
+	return l, nil
+}
+
+// warnKernelEcho logs a warning if the kernel answers the echo requests of
+// an address family itself.
+func warnKernelEcho(v6 bool) {
+	path := "/proc/sys/net/ipv4/icmp_echo_ignore_all"
+	if v6 {
+		path = "/proc/sys/net/ipv6/icmp/echo_ignore_all"
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != "0" {
+		return // not Linux, or a kernel without the setting
+	}
+	name := strings.ReplaceAll(strings.TrimPrefix(path, "/proc/sys/"), "/", ".")
+	log.Printf("icmp server: the kernel answers echo requests itself and its replies may take the place of the tunnel's; set %s=1", name)
+}
+
+// Accept waits for the next client session.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops answering and closes every session.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		for _, sock := range l.socks {
+			err = errors.Join(err, sock.pc.Close())
+		}
+		l.mu.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[sessionKey]*Session)
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the wildcard address the listener answers on, the IPv4 one
+// if it has both.
+func (l *Listener) Addr() net.Addr { return l.socks[0].pc.LocalAddr() }
+
+func (l *Listener) readLoop(sock *socket) {
+	request := uint8(codec.ICMPEchoRequest)
+	if sock.v6 {
+		request = codec.ICMPv6EchoRequest
+	}
+	// fragments are reassembled per source so clients can't mix them up
+	reasm := newReassemblers()
+	// early holds the credits of requests of sessions yet to start, which
+	// they start with once a message completes
+	early := make(map[sessionKey][]credit)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := sock.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		typ, _, id, seq, payload, err := codec.ParseICMPEcho(buf[:n])
+		if err != nil || typ != request {
+			continue
+		}
+		session, fseq, idx, total, data, err := codec.ParseFragmentPayload(payload)
+		if err != nil {
+			continue
+		}
+		// every request of a session is a reply credit, whether or not it
+		// completes a message
+		s := l.lookup(addr, session)
+		if s != nil {
+			s.request(id, seq)
+		} else {
+			key := sessionKey{addr.String(), session}
+			if len(early) >= maxEarly {
+				pruneEarly(early)
+			}
+			if c := early[key]; len(c) < maxCredits && (len(early) < maxEarly || c != nil) {
+				early[key] = append(c, credit{id, seq, time.Now()})
+			}
+		}
+
+		r := reasm.get(addr.String(), time.Now())
+		// the reassembler keeps the slice, so it must not alias buf
+		data = append([]byte(nil), data...)
+		complete, assembled, err := r.AddFragment(session, fseq, idx, total, data)
+		if err != nil || !complete {
+			continue
+		}
+		msg, err := codec.DecryptAES(l.key, assembled)
+		if err != nil {
+			continue // another tunnel's key, or noise
+		}
+		if s == nil {
+			key := sessionKey{addr.String(), session}
+			credits := early[key]
+			delete(early, key)
+			if s = l.session(sock, addr, session); s == nil {
+				continue
+			}
+			// the credits include this request's
+			s.mu.Lock()
+			s.credits = append(credits, s.credits...)
+			s.lastSeen = time.Now()
+			s.flush()
+			s.mu.Unlock()
+		}
+		// fragment sequence 0 is a poll, which carries nothing
+		if fseq != 0 {
+			s.mu.Lock()
+			s.answer = fseq
+			s.mu.Unlock()
+			s.Deliver(msg)
+		}
+	}
+}
+
+// reassemblers holds a fragment reassembler per source address.
+type reassemblers struct {
+	bySrc map[string]*sourceReasm
+	swept time.Time
+}
+
+type sourceReasm struct {
+	r        *codec.Reassembler
+	lastSeen time.Time
+}
+
+func newReassemblers() *reassemblers {
+	return &reassemblers{bySrc: make(map[string]*sourceReasm)}
+}
+
+// get returns the reassembler of src, starting one if there is none. It
+// drops those of sources that went quiet, and past maxSources the one
+// heard from least recently.
+func (rs *reassemblers) get(src string, now time.Time) *codec.Reassembler {
+	if now.Sub(rs.swept) > reasmTimeout {
+		for k, sr := range rs.bySrc {
+			if now.Sub(sr.lastSeen) > reasmTimeout {
+				delete(rs.bySrc, k)
+			}
+		}
+		rs.swept = now
+	}
+	sr, ok := rs.bySrc[src]
+	if !ok {
+		if len(rs.bySrc) >= maxSources {
+			var quiet string
+			for k, v := range rs.bySrc {
+				if quiet == "" || v.lastSeen.Before(rs.bySrc[quiet].lastSeen) {
+					quiet = k
+				}
+			}
+			delete(rs.bySrc, quiet)
+		}
+		sr = &sourceReasm{r: codec.NewReassembler(reasmTimeout)}
+		rs.bySrc[src] = sr
+	}
+	sr.lastSeen = now
+	return sr.r
+}
+
+// pruneEarly drops the stale credits of sessions yet to start.
+func pruneEarly(early map[sessionKey][]credit) {
+	for key, credits := range early {
+		if time.Since(credits[len(credits)-1].at) > requestFresh {
+			delete(early, key)
+		}
+	}
+}
+
+// lookup returns the session of src with the given ID, nil if there is
+// none.
+func (l *Listener) lookup(src net.Addr, id uint16) *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sessions[sessionKey{src.String(), id}]
+}
+
+// session returns the session of src with the given ID, starting one on
+// sock if there is none. It returns nil if the accept backlog is full.
+func (l *Listener) session(sock *socket, src net.Addr, id uint16) *Session {
+	key := sessionKey{src.String(), id}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.sessions[key]; ok {
+		return s
+	}
+	s := &Session{l: l, sock: sock, key: key, src: src}
+	if sock.v6 {
+		local, err := codec.SourceIP(src.(*net.IPAddr).IP)
+		if err != nil {
+			return nil
+		}
+		s.local = local
+	}
+	s.Conn = msgconn.New(sock.pc.LocalAddr(), src, s.reply, func() error {
+		l.mu.Lock()
+		if l.sessions[key] == s {
+			delete(l.sessions, key)
+		}
+		l.mu.Unlock()
+		return nil
+	})
+	select {
+	case l.accept <- s:
+	default:
+		return nil
+	}
+	l.sessions[key] = s
+	return s
+}
+
+// ID returns the session ID the client chose.
+func (s *Session) ID() uint16 { return s.key.id }
+
+// reply queues msg for the client and sends what its credits allow.
+func (s *Session) reply(msg []byte) error {
+	sealed, err := codec.EncryptAES(s.l.key, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.answer
+	if seq == 0 {
+		if s.seq++; s.seq < codec.ServerSeqBase {
+			s.seq = codec.ServerSeqBase
+		}
+		seq = s.seq
+	}
+	s.answer = 0
+	frags, err := codec.SimpleFragment(s.key.id, seq, sealed, fragmentSize)
+	if err != nil {
+		return err
+	}
+	if len(s.queued)+len(frags) > maxQueued {
+		return nil // dropped, as a datagram would be
+	}
+	s.queued = append(s.queued, frags...)
+	return s.flush()
+}
+
+// request takes in an echo request of the session as a reply credit and
+// spends what it can.
+func (s *Session) request(id, seq uint16) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	if len(s.credits) >= maxCredits {
+		s.credits = s.credits[1:]
+	}
+	s.credits = append(s.credits, credit{id, seq, now})
+	s.flush()
+}
+
+// flush sends queued fragments, one in reply to each fresh request, the
+// oldest first. s.mu must be held.
+func (s *Session) flush() error {
+	for len(s.credits) > 0 && time.Since(s.credits[0].at) > requestFresh {
+		s.credits = s.credits[1:]
+	}
+	for len(s.queued) > 0 && len(s.credits) > 0 {
+		c := s.credits[0]
+		s.credits = s.credits[1:]
+		if err := s.send(c.id, c.seq, s.queued[0]); err != nil {
+			return err
+		}
+		s.queued = s.queued[1:]
+	}
+	return nil
+}
+
+// send writes frag in an echo reply to the request id and seq.
+func (s *Session) send(id, seq uint16, frag []byte) error {
+	pkt := codec.BuildICMPEcho(codec.ICMPEchoReply, 0, id, seq, frag)
+	if s.sock.v6 {
+		pkt = codec.BuildICMPv6Echo(codec.ICMPv6EchoReply, 0, id, seq, frag, s.local, s.src.(*net.IPAddr).IP)
+	}
+	_, err := s.sock.pc.WriteTo(pkt, s.src)
+	return err
+}
+
+func (l *Listener) expire() {
+	tick := time.NewTicker(sessionIdle / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			l.mu.Lock()
+			var idle []*Session
+			for _, s := range l.sessions {
+				s.mu.Lock()
+				if now.Sub(s.lastSeen) > sessionIdle {
+					idle = append(idle, s)
+				}
+				s.mu.Unlock()
+			}
+			l.mu.Unlock()
+			for _, s := range idle {
+				s.Close()
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReassemblersForgetQuietSources(t *testing.T) {
+	rs := newReassemblers()
+	start := time.Now()
+	for i := 0; i < 4*maxSources; i++ {
+		src := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		rs.get(src, start).AddFragment(uint16(i), 1, 0, 255, []byte("junk"))
+		if len(rs.bySrc) > maxSources {
+			t.Fatalf("tracking %d sources", len(rs.bySrc))
+		}
+	}
+
+	// a client still talking keeps its reassembler through the flood
+	later := start.Add(reasmTimeout / 2)
+	client := rs.get("192.0.2.1", later)
+	client.AddFragment(1, 1, 0, 2, []byte("hello, "))
+	if rs.get("192.0.2.1", later.Add(time.Second)) != client {
+		t.Fatal("active source lost its reassembler")
+	}
+
+	rs.get("192.0.2.1", start.Add(reasmTimeout+time.Second))
+	if len(rs.bySrc) != 1 {
+		t.Fatalf("tracking %d sources after the junk went quiet", len(rs.bySrc))
+	}
+	if _, msg, _ := client.AddFragment(1, 1, 1, 2, []byte("world")); string(msg) != "hello, world" {
+		t.Fatalf("message = %q", msg)
+	}
+}
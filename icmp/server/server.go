@@ -1,85 +1,282 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	codec "icmp-tunnel/pkg"
+	"io"
+	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-func Server(udpTarget string) error {
-	var secretKey = []byte("0123456789abcdef")
+// Handler builds the reply for one reassembled, decrypted request from src.
+type Handler func(src net.Addr, req []byte) []byte
 
-	icmpConn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
-	if err != nil {
-		return fmt.Errorf("listen icmp failed: %v", err)
+// Limits bounds the session table of Forward. Zero fields take the
+// defaults.
+type Limits struct {
+	// MaxSessions is how many sessions are forwarded at once, 1024 by
+	// default; sessions past it are closed as they start.
+	MaxSessions int
+	// MaxPerSource is how many of them one source address may hold, 64
+	// by default.
+	MaxPerSource int
+	// Idle closes a session and its upstream socket once nothing went
+	// either way for that long, 2 minutes by default.
+	Idle time.Duration
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxSessions <= 0 {
+		l.MaxSessions = 1024
+	}
+	if l.MaxPerSource <= 0 {
+		l.MaxPerSource = 64
 	}
+	if l.Idle <= 0 {
+		l.Idle = 2 * time.Minute
+	}
+	return l
+}
+
+// Server forwards the datagrams of every ICMP client to the UDP service at
+// udpTarget and those of the service back, until the process exits.
+func Server(udpTarget string, secretKey []byte) error {
+	_, err := Forward(udpTarget, secretKey, Limits{})
+	return err
+}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", udpTarget)
+// nat is the session table of Forward. Like a NAT it gives every client
+// session, told apart by source address and fragment session ID, an
+// upstream UDP socket of its own, so the replies of the service go back to
+// the session that asked and sessions don't wait on each other.
+type nat struct {
+	l      *Listener
+	target *net.UDPAddr
+	limits Limits
+
+	mu      sync.Mutex
+	entries map[sessionKey]*natEntry
+	// perSource counts the entries of every source address
+	perSource map[string]int
+	// refused holds when sessions were last turned away, to log that once
+	// rather than at every poll
+	refused map[sessionKey]time.Time
+	closed  bool
+	done    chan struct{}
+}
+
+type natEntry struct {
+	s        *Session
+	up       *net.UDPConn
+	lastUsed time.Time // guarded by nat.mu
+}
+
+// Forward relays every client session to the UDP service at udpTarget
+// through a UDP socket of its own, within limits, until the returned
+// Closer is closed.
+func Forward(udpTarget string, secretKey []byte, limits Limits) (io.Closer, error) {
+	target, err := net.ResolveUDPAddr("udp", udpTarget)
+	if err != nil {
+		return nil, fmt.Errorf("resolve udp target failed: %v", err)
+	}
+	l, err := Listen(secretKey)
 	if err != nil {
-		return fmt.Errorf("resolve udp target failed: %v", err)
+		return nil, err
+	}
+	n := &nat{
+		l:         l,
+		target:    target,
+		limits:    limits.withDefaults(),
+		entries:   make(map[sessionKey]*natEntry),
+		perSource: make(map[string]int),
+		refused:   make(map[sessionKey]time.Time),
+		done:      make(chan struct{}),
 	}
+	go n.acceptLoop()
+	go n.expireLoop()
+	return n, nil
+}
+
+func (n *nat) acceptLoop() {
+	for {
+		c, err := n.l.Accept()
+		if err != nil {
+			return
+		}
+		s := c.(*Session)
+		e, err := n.add(s)
+		if err != nil {
+			n.mu.Lock()
+			_, again := n.refused[s.key]
+			n.refused[s.key] = time.Now()
+			n.mu.Unlock()
+			if !again {
+				log.Printf("icmp server: session %04x from %s: %v", s.ID(), s.RemoteAddr(), err)
+			}
+			s.Close()
+			continue
+		}
+		go n.forward(e)
+	}
+}
 
-	udpConn, err := net.DialUDP("udp", nil, udpAddr)
+// add dials the upstream socket of s and enters it in the table.
+func (n *nat) add(s *Session) (*natEntry, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case n.closed:
+		return nil, net.ErrClosed
+	case len(n.entries) >= n.limits.MaxSessions:
+		return nil, fmt.Errorf("session table full (%d)", n.limits.MaxSessions)
+	case n.perSource[s.key.src] >= n.limits.MaxPerSource:
+		return nil, fmt.Errorf("source holds %d sessions already", n.limits.MaxPerSource)
+	}
+	up, err := net.DialUDP("udp", nil, n.target)
 	if err != nil {
-		return fmt.Errorf("listen udp failed: %v", err)
+		return nil, fmt.Errorf("dial udp target failed: %v", err)
 	}
-	// _, err = udpConn.Write(assembled)
-	reasm := codec.NewReassembler(5 * time.Second)
-	buf := make([]byte, 65535)
+	e := &natEntry{s: s, up: up, lastUsed: time.Now()}
+	n.entries[s.key] = e
+	n.perSource[s.key.src]++
+	return e, nil
+}
 
+// remove closes e and takes it out of the table.
+func (n *nat) remove(e *natEntry) {
+	n.mu.Lock()
+	if n.entries[e.s.key] == e {
+		delete(n.entries, e.s.key)
+		if n.perSource[e.s.key.src]--; n.perSource[e.s.key.src] == 0 {
+			delete(n.perSource, e.s.key.src)
+		}
+	}
+	n.mu.Unlock()
+	e.up.Close()
+	e.s.Close()
+}
+
+func (n *nat) touch(e *natEntry) {
+	n.mu.Lock()
+	e.lastUsed = time.Now()
+	n.mu.Unlock()
+}
+
+// forward writes every request of the session to its upstream socket,
+// and every datagram that comes back on it, however late and however
+// many, to the session, which queues them for the client's next requests.
+func (n *nat) forward(e *natEntry) {
+	defer n.remove(e)
 	go func() {
+		// ends the upstream loop below as well
+		defer e.s.Close()
+		buf := make([]byte, 65535)
 		for {
-			n, addr, err := icmpConn.ReadFrom(buf)
-			if err != nil {
-				continue
-			}
-
-			typ, _, id, seq, payload, err := codec.ParseICMPEcho(buf[:n])
-			if err != nil || typ != 8 {
-				continue
+			nr, err := e.up.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-
-			session, seqNum, idx, total, data, err := codec.ParseFragmentPayload(payload)
 			if err != nil {
-				continue
+				continue // e.g. refused while the service restarts
+			}
+			n.touch(e)
+			if _, err := e.s.Write(buf[:nr]); err != nil {
+				return
 			}
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		nr, err := e.s.Read(buf)
+		if err != nil {
+			return
+		}
+		n.touch(e)
+		e.up.Write(buf[:nr])
+	}
+}
 
-			complete, assembled, err := reasm.AddFragment(session, seqNum, idx, total, data)
-			if err != nil || !complete {
-				continue
+// expireLoop closes the sessions idle for longer than the limit.
+func (n *nat) expireLoop() {
+	tick := time.NewTicker(max(n.limits.Idle/4, 10*time.Millisecond))
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-n.done:
+			return
+		}
+		var idle []*natEntry
+		n.mu.Lock()
+		for _, e := range n.entries {
+			if now.Sub(e.lastUsed) > n.limits.Idle {
+				idle = append(idle, e)
 			}
-			//
-			assembled, err = codec.DecryptAES(secretKey, assembled)
-			if err != nil {
-				continue // ignore if decryption failed
+		}
+		for key, t := range n.refused {
+			if now.Sub(t) > time.Minute {
+				delete(n.refused, key)
 			}
-			//
-			_, err = udpConn.Write(assembled)
+		}
+		n.mu.Unlock()
+		for _, e := range idle {
+			n.remove(e)
+		}
+	}
+}
+
+// Close stops answering and closes every session with its socket.
+func (n *nat) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	entries := n.entries
+	n.entries = make(map[sessionKey]*natEntry)
+	n.perSource = make(map[string]int)
+	n.mu.Unlock()
+	err := n.l.Close()
+	for _, e := range entries {
+		e.up.Close()
+		e.s.Close()
+	}
+	return err
+}
+
+// Serve listens for tunnel requests sealed with secretKey on ICMP and
+// answers each one with the reply returned by handler. Sessions are handled
+// concurrently until the returned Closer is closed.
+func Serve(secretKey []byte, handler Handler) (io.Closer, error) {
+	l, err := Listen(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
 			if err != nil {
-				continue
-			}
-			rbuf := make([]byte, 65535)
-			udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			nr, _, err := udpConn.ReadFromUDP(rbuf)
-			reply := []byte{}
-			if err == nil {
-				reply = rbuf[:nr]
+				return
 			}
-			frags, _ := codec.SimpleFragment(session, seqNum, reply, 1400)
-			for _, frag := range frags {
-				replyPkt := codec.BuildICMPEcho(0, 0, id, seq, frag)
-				sendConn, err := net.Dial("ip4:icmp", addr.String())
-				if err != nil {
-					fmt.Println("Failed to dial icmp")
-					continue
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 65535)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(handler(c.RemoteAddr(), buf[:n])); err != nil {
+						return
+					}
 				}
-				fmt.Println(replyPkt)
-				fmt.Println("send")
-				sendConn.Write(replyPkt)
-				sendConn.Close()
-			}
+			}()
 		}
 	}()
-	return nil
+	return l, nil
 }
@@ -0,0 +1,188 @@
+// Package msgconn adapts carriers that move whole messages to net.Conn.
+//
+// Every Write sends one message and every Read returns one message, like a
+// connected UDP socket; a Read buffer too short for a message gets its
+// head and io.ErrShortBuffer.
+package msgconn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueLen bounds the messages waiting to be read; more are dropped.
+const queueLen = 256
+
+// Conn is a net.Conn fed by Deliver and draining through a send function.
+type Conn struct {
+	local, remote net.Addr
+	send          func([]byte) error
+	onClose       func() error
+
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+	err    error // returned by Read once closed and drained
+
+	mu sync.Mutex
+	// readWake is closed and replaced when the read deadline changes
+	readWake      chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// New returns a Conn between local and remote that hands written messages
+// to send. onClose, if set, runs once when the Conn is closed.
+func New(local, remote net.Addr, send func([]byte) error, onClose func() error) *Conn {
+	return &Conn{
+		local:    local,
+		remote:   remote,
+		send:     send,
+		onClose:  onClose,
+		in:       make(chan []byte, queueLen),
+		closed:   make(chan struct{}),
+		readWake: make(chan struct{}),
+	}
+}
+
+// Deliver queues a received message for Read. It reports false if the
+// message was dropped because the Conn is closed or its queue is full.
+func (c *Conn) Deliver(b []byte) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	select {
+	case c.in <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read returns the next message.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.readDeadline, c.readWake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		stop := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+
+		select {
+		case m := <-c.in:
+			stop()
+			n := copy(b, m)
+			if n < len(m) {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		case <-c.closed:
+			stop()
+			// messages that arrived before the close are still read
+			select {
+			case m := <-c.in:
+				return copy(b, m), nil
+			default:
+			}
+			return 0, c.err
+		case <-expired:
+		case <-wake:
+			stop()
+		}
+	}
+}
+
+// Write sends b as one message.
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := c.send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the Conn; pending and later Reads return net.ErrClosed.
+func (c *Conn) Close() error {
+	return c.CloseWithError(net.ErrClosed)
+}
+
+// CloseWithError closes the Conn so that Read returns err, e.g. io.EOF when
+// the peer hung up, once the queued messages are read.
+func (c *Conn) CloseWithError(err error) error {
+	first := false
+	c.once.Do(func() {
+		first = true
+		c.err = err
+		close(c.closed)
+	})
+	if first && c.onClose != nil {
+		return c.onClose()
+	}
+	return nil
+}
+
+// Done is closed when the Conn is.
+func (c *Conn) Done() <-chan struct{} { return c.closed }
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.readWake)
+	c.readWake = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the time after which Write fails. A Write already
+// handing its message to the carrier is not interrupted.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// WriteDeadline returns the current write deadline, for send functions that can
+// honour it.
+func (c *Conn) WriteDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeDeadline
+}
@@ -0,0 +1,57 @@
+package msgconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	var sent [][]byte
+	c := New(&net.IPAddr{}, &net.IPAddr{}, func(b []byte) error {
+		sent = append(sent, b)
+		return nil
+	}, nil)
+
+	c.Write([]byte("out"))
+	if len(sent) != 1 || string(sent[0]) != "out" {
+		t.Fatalf("sent = %q", sent)
+	}
+
+	c.Deliver([]byte("hello"))
+	buf := make([]byte, 3)
+	if n, err := c.Read(buf); n != 3 || err != io.ErrShortBuffer {
+		t.Fatalf("short read = %d, %v", n, err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+
+	// a deadline moved while Read waits takes effect
+	c.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.SetReadDeadline(time.Now())
+	}()
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with shortened deadline: %v", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	c.Deliver([]byte("last"))
+	c.CloseWithError(io.EOF)
+	if n, err := c.Read(make([]byte, 10)); n != 4 || err != nil {
+		t.Fatalf("read queued after close = %d, %v", n, err)
+	}
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Fatalf("read after close: %v", err)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after close: %v", err)
+	}
+}
@@ -4,12 +4,22 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"net"
 	"time"
 )
 
 var ErrIncompleteFragment = errors.New("incomplete fragment")
 
 // ------------------- ICMP Echo -------------------
+
+// Echo message types of ICMP for IPv4 and of ICMPv6.
+const (
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
 func BuildICMPEcho(typ, code uint8, id, seq uint16, payload []byte) []byte {
 	buf := make([]byte, 8+len(payload))
 	buf[0] = typ
@@ -23,6 +33,47 @@ func BuildICMPEcho(typ, code uint8, id, seq uint16, payload []byte) []byte {
 	return buf
 }
 
+// BuildICMPv6Echo is BuildICMPEcho for ICMPv6, whose checksum also covers
+// the IPv6 pseudo header of the packet from src to dst. ParseICMPEcho
+// reads the result.
+func BuildICMPv6Echo(typ, code uint8, id, seq uint16, payload []byte, src, dst net.IP) []byte {
+	buf := make([]byte, 8+len(payload))
+	buf[0] = typ
+	buf[1] = code
+	binary.BigEndian.PutUint16(buf[4:6], id)
+	binary.BigEndian.PutUint16(buf[6:8], seq)
+	copy(buf[8:], payload)
+	binary.BigEndian.PutUint16(buf[2:4], ICMPv6Checksum(src, dst, buf))
+	return buf
+}
+
+// ICMPv6Checksum is the checksum of the ICMPv6 message msg sent from src
+// to dst: the Internet checksum over the IPv6 pseudo header and msg, with
+// the checksum field of msg taken as zero.
+func ICMPv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	pseudo := make([]byte, 40+len(msg))
+	copy(pseudo[0:16], src.To16())
+	copy(pseudo[16:32], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(msg)))
+	pseudo[39] = 58 // next header: ICMPv6
+	copy(pseudo[40:], msg)
+	if len(msg) >= 4 {
+		pseudo[42], pseudo[43] = 0, 0
+	}
+	return icmpChecksum(pseudo)
+}
+
+// SourceIP returns the local address packets to dst leave from, which the
+// ICMPv6 checksum covers. It sends nothing.
+func SourceIP(dst net.IP) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
 func ParseICMPEcho(pkt []byte) (typ, code uint8, id, seq uint16, payload []byte, err error) {
 	if len(pkt) < 8 {
 		err = errors.New("packet too short")
@@ -53,6 +104,13 @@ func icmpChecksum(data []byte) uint16 {
 // ------------------- Fragment Payload -------------------
 // Layout: session(2) + seq(2) + idx(1) + total(1) + data
 
+// ServerSeqBase splits the message sequence numbers. Clients number their
+// messages from 1 up to below it, 0 being for polls. The server numbers
+// the first reply after a client message with the sequence of that
+// message, so the client can pair them, and every other reply from
+// ServerSeqBase up.
+const ServerSeqBase = 0x8000
+
 func BuildFragmentPayload(session, seq uint16, idx, total uint8, data []byte) []byte {
 	buf := make([]byte, 6+len(data))
 	binary.BigEndian.PutUint16(buf[0:2], session)
@@ -82,27 +140,57 @@ type fragmentKey struct {
 	seq     uint16
 }
 
-type reassembler struct {
+// A Reassembler holds at most maxPending incomplete messages and
+// maxPendingBytes of their fragments; past either it drops the messages
+// that would expire first.
+const (
+	maxPending      = 256
+	maxPendingBytes = 1 << 20
+)
+
+// Reassembler collects fragments until a message is complete. Messages
+// still incomplete after its timeout are dropped.
+type Reassembler struct {
 	frags   map[fragmentKey]map[uint8][]byte
 	expire  map[fragmentKey]time.Time
 	timeout time.Duration
+	// size is the fragment data held in frags
+	size int
 }
 
-func NewReassembler(timeout time.Duration) *reassembler {
-	return &reassembler{
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
 		frags:   make(map[fragmentKey]map[uint8][]byte),
 		expire:  make(map[fragmentKey]time.Time),
 		timeout: timeout,
 	}
 }
 
-func (r *reassembler) AddFragment(session, seq uint16, idx, total uint8, data []byte) (complete bool, assembled []byte, err error) {
+func (r *Reassembler) AddFragment(session, seq uint16, idx, total uint8, data []byte) (complete bool, assembled []byte, err error) {
 	key := fragmentKey{session, seq}
 	if _, ok := r.frags[key]; !ok {
+		now := time.Now()
+		for k, t := range r.expire {
+			if now.After(t) {
+				r.drop(k)
+			}
+		}
+		for len(r.frags) >= maxPending {
+			r.drop(r.oldest())
+		}
 		r.frags[key] = make(map[uint8][]byte)
-		r.expire[key] = time.Now().Add(r.timeout)
+		r.expire[key] = now.Add(r.timeout)
 	}
+	r.size += len(data) - len(r.frags[key][idx])
 	r.frags[key][idx] = data
+	for r.size > maxPendingBytes {
+		old := r.oldest()
+		r.drop(old)
+		if old == key {
+			err = ErrIncompleteFragment
+			return
+		}
+	}
 
 	// check if all fragments present
 	if uint8(len(r.frags[key])) < total {
@@ -121,9 +209,28 @@ func (r *reassembler) AddFragment(session, seq uint16, idx, total uint8, data []
 	}
 	assembled = buf.Bytes()
 	complete = true
+	r.drop(key)
+	return
+}
+
+// oldest returns the key of the message that expires first.
+func (r *Reassembler) oldest() fragmentKey {
+	var key fragmentKey
+	var first time.Time
+	for k, t := range r.expire {
+		if first.IsZero() || t.Before(first) {
+			key, first = k, t
+		}
+	}
+	return key
+}
+
+func (r *Reassembler) drop(key fragmentKey) {
+	for _, d := range r.frags[key] {
+		r.size -= len(d)
+	}
 	delete(r.frags, key)
 	delete(r.expire, key)
-	return
 }
 
 // SimpleFragment splits data into chunks of size <= maxLen
@@ -2,6 +2,8 @@ package pkg
 
 import (
 	"bytes"
+	"encoding/binary"
+	"net"
 	"testing"
 	"time"
 )
@@ -43,6 +45,38 @@ func TestFragmentReassemble(t *testing.T) {
 	}
 }
 
+func TestReassemblerBounds(t *testing.T) {
+	r := NewReassembler(50 * time.Millisecond)
+	r.AddFragment(1, 1, 0, 2, []byte("stale"))
+	time.Sleep(60 * time.Millisecond)
+	r.AddFragment(1, 2, 0, 2, []byte("fresh"))
+	if _, ok := r.frags[fragmentKey{1, 1}]; ok {
+		t.Fatal("expired message kept")
+	}
+
+	r = NewReassembler(time.Minute)
+	for seq := uint16(1); seq <= 2*maxPending; seq++ {
+		r.AddFragment(1, seq, 0, 2, make([]byte, 1000))
+	}
+	if len(r.frags) > maxPending || r.size > maxPendingBytes {
+		t.Fatalf("holding %d messages of %d bytes", len(r.frags), r.size)
+	}
+	if _, ok := r.frags[fragmentKey{1, 2 * maxPending}]; !ok {
+		t.Fatal("newest message dropped")
+	}
+	for seq := uint16(1); seq <= 20; seq++ {
+		r.AddFragment(2, seq, 0, 2, make([]byte, 60000))
+	}
+	if r.size > maxPendingBytes {
+		t.Fatalf("holding %d bytes", r.size)
+	}
+	// what is left still completes
+	c, a, err := r.AddFragment(2, 20, 1, 2, []byte("end"))
+	if !c || err != nil || len(a) != 60003 {
+		t.Fatalf("AddFragment = %v, %d bytes, %v", c, len(a), err)
+	}
+}
+
 func TestFragmentPayloadTooShort(t *testing.T) {
 	_, _, _, _, _, err := ParseFragmentPayload([]byte{0, 1, 2})
 	if err == nil {
@@ -64,3 +98,23 @@ func TestICMPEchoBuildParse(t *testing.T) {
 		t.Fatalf("Parse mismatch. Got typ=%d code=%d id=%d seq=%d payload=%s", typ, code, pid, pse, pl)
 	}
 }
+
+func TestICMPv6EchoChecksum(t *testing.T) {
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("fe80::2")
+	pkt := BuildICMPv6Echo(ICMPv6EchoRequest, 0, 42, 7, []byte("ping6"), src, dst)
+	if got := ICMPv6Checksum(src, dst, pkt); got != binary.BigEndian.Uint16(pkt[2:4]) {
+		t.Fatalf("checksum %#04x does not verify, recomputed %#04x", binary.BigEndian.Uint16(pkt[2:4]), got)
+	}
+	// summing a packet with its checksum in place yields zero
+	pseudo := append(append(append([]byte(nil), src...), dst...), 0, 0, 0, byte(len(pkt)), 0, 0, 0, 58)
+	if icmpChecksum(append(pseudo, pkt...)) != 0 {
+		t.Fatal("checksum does not cover the pseudo header")
+	}
+	if ICMPv6Checksum(src, net.ParseIP("fe80::3"), pkt) == binary.BigEndian.Uint16(pkt[2:4]) {
+		t.Fatal("checksum ignores the destination address")
+	}
+	typ, _, id, seq, payload, err := ParseICMPEcho(pkt)
+	if err != nil || typ != ICMPv6EchoRequest || id != 42 || seq != 7 || string(payload) != "ping6" {
+		t.Fatalf("ParseICMPEcho = %d %d %d %q %v", typ, id, seq, payload, err)
+	}
+}
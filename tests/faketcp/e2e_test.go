@@ -36,6 +36,8 @@ func startTestUDPBackend(port string) (*net.UDPConn, error) {
 	return conn, nil
 }
 
+var testKey = []byte("e2e-tunnel-key!!")
+
 func TestE2ETunnel(t *testing.T) {
 	if os.Geteuid() != 0 {
 		t.Skip("must run as root for raw ICMP sockets")
@@ -49,30 +51,30 @@ func TestE2ETunnel(t *testing.T) {
 		t.Fatalf("backend start failed: %v", err)
 	}
 
-	err = server.Server(backendPort)
+	err = server.Server(backendPort, testKey)
 	if err != nil {
 		t.Fatalf("tunnel server start failed: %v", err)
 	}
 
 	time.Sleep(500 * time.Millisecond)
 	testPayload := []byte("Hello Tunnel Test!")
-	con, err := client.Client(serverTunnelIP, ":9000")
+	con, err := client.Client(serverTunnelIP)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	resp, err := client.SendData(con, serverTunnelIP, testPayload)
+	resp, err := client.SendData(con, serverTunnelIP, testKey, testPayload)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	if string(resp) != string(testPayload) {
+	if string(resp) != "ECHO: "+string(testPayload) {
 		t.Fatalf("Unexpected response: %s", string(resp))
 	}
 	//
-	resp, err = client.SendData(con, serverTunnelIP, testPayload)
+	resp, err = client.SendData(con, serverTunnelIP, testKey, testPayload)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	if string(resp) != string(testPayload) {
+	if string(resp) != "ECHO: "+string(testPayload) {
 		t.Fatalf("Unexpected response: %s", string(resp))
 	}
 }
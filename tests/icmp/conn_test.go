@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"icmp-tunnel/icmp/client"
+	"icmp-tunnel/icmp/server"
+	codec "icmp-tunnel/pkg"
+)
+
+var connKey = []byte("icmp-conn-key!!!")
+
+func TestConnAcceptsSessions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+
+	l, err := server.Listen(connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				id := c.(*server.Session).ID()
+				buf := make([]byte, 65535)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(c, "%04x: %s", id, buf[:n])
+				}
+			}()
+		}
+	}()
+
+	// ICMPv6 is chosen by the address family of the server
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			// two tunnels from the same host are two sessions
+			for i := 0; i < 2; i++ {
+				c, err := client.Dial(host, connKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				buf := make([]byte, 65535)
+				for _, msg := range []string{"hello", string(make([]byte, 5000))} {
+					if _, err := c.Write([]byte(msg)); err != nil {
+						t.Fatal(err)
+					}
+					c.SetReadDeadline(time.Now().Add(2 * time.Second))
+					n, err := c.Read(buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want := fmt.Sprintf("%04x: %s", c.Session(), msg); string(buf[:n]) != want {
+						t.Fatalf("reply = %.20q..., want %.20q...", buf[:n], want)
+					}
+				}
+
+				c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("read past deadline: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestConnPollsForPushes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	l, err := server.Listen(connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := client.Dial("127.0.0.1", connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the first poll opens the session without a message
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.(*server.Session).ID(); got != c.Session() {
+		t.Fatalf("session %04x, want %04x", got, c.Session())
+	}
+	// idle, the client polls slowly but often enough for pushes
+	time.Sleep(3 * time.Second)
+	s.Write([]byte("unasked"))
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "unasked" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestConnReceivesBursts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	l, err := server.Listen(connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := client.Dial("127.0.0.1", connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("go"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// far more fragments than the client has requests out at first
+	const count = 50
+	for i := range count {
+		s.Write(append([]byte(fmt.Sprintf("%02d", i)), make([]byte, 5000)...))
+	}
+	buf := make([]byte, 65535)
+	for i := range count {
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if got := string(buf[:2]); n != 5002 || got != fmt.Sprintf("%02d", i) {
+			t.Fatalf("message %d: %d bytes starting %q", i, n, got)
+		}
+	}
+}
+
+func TestOneReplyPerRequest(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	l, err := server.Listen(connKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a client by hand, whose requests a NAT would have given other
+	// identifiers
+	pc, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	const session = 0x4242
+	server127 := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	sent := make(map[string]bool)
+	request := func(id, seq uint16, fseq uint16, msg []byte) {
+		sealed, err := codec.EncryptAES(connKey, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frag := codec.BuildFragmentPayload(session, fseq, 0, 1, sealed)
+		sent[string(frag)] = true
+		pc.WriteTo(codec.BuildICMPEcho(codec.ICMPEchoRequest, 0, id, seq, frag), server127)
+	}
+	// replies returns the identifiers of the replies for the session
+	replies := func() []string {
+		var got []string
+		buf := make([]byte, 65535)
+		pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return got
+			}
+			typ, _, id, seq, payload, err := codec.ParseICMPEcho(buf[:n])
+			if err != nil || typ != codec.ICMPEchoReply || sent[string(payload)] {
+				continue
+			}
+			if sess, _, _, _, _, err := codec.ParseFragmentPayload(payload); err == nil && sess == session {
+				got = append(got, fmt.Sprintf("%d/%d", id, seq))
+			}
+		}
+	}
+
+	request(1, 1, 1, []byte("hello"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		s.Write([]byte("queued"))
+	}
+	if got := replies(); strings.Join(got, " ") != "1/1" {
+		t.Fatalf("replies to one request: %q", got)
+	}
+	// polls under other identifiers are credits of the same session
+	request(7, 100, 0, nil)
+	request(9, 200, 0, nil)
+	if got := replies(); strings.Join(got, " ") != "7/100 9/200" {
+		t.Fatalf("replies to two polls: %q", got)
+	}
+}
@@ -37,6 +37,8 @@ func startTestUDPBackend(port string) (*net.UDPConn, error) {
 	return conn, nil
 }
 
+var testKey = []byte("e2e-tunnel-key!!")
+
 func TestE2ETunnel(t *testing.T) {
 	if os.Geteuid() != 0 {
 		t.Skip("must run as root for raw ICMP sockets")
@@ -50,30 +52,83 @@ func TestE2ETunnel(t *testing.T) {
 		t.Fatalf("backend start failed: %v", err)
 	}
 
-	err = server.Server(serverTunnelIP + backendPort)
+	err = server.Server(serverTunnelIP+backendPort, testKey)
 	if err != nil {
 		t.Fatalf("tunnel server start failed: %v", err)
 	}
 
 	time.Sleep(500 * time.Millisecond)
 	testPayload := []byte("Hello ")
-	con, err := client.Client(serverTunnelIP, ":9000")
+	con, err := client.Client(serverTunnelIP)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	resp, err := client.SendData(con, serverTunnelIP, testPayload)
+	resp, err := client.SendData(con, serverTunnelIP, testKey, testPayload)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	if string(resp) != string(testPayload) {
+	if string(resp) != "ECHO: "+string(testPayload) {
 		t.Fatalf("Unexpected response: %s", string(resp))
 	}
 
-	resp, err = client.SendData(con, serverTunnelIP, testPayload)
+	resp, err = client.SendData(con, serverTunnelIP, testKey, testPayload)
 	if err != nil {
 		t.Fatalf("Tunnel test failed: %v", err)
 	}
-	if string(resp) != string(testPayload) {
+	if string(resp) != "ECHO: "+string(testPayload) {
 		t.Fatalf("Unexpected response: %s", string(resp))
 	}
 }
+
+func TestSendDataSkipsLateReply(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	// the backend answers "slow" only after SendData gave up on it
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			reply := append([]byte("ECHO: "), buf[:n]...)
+			if string(buf[:n]) == "slow" {
+				time.AfterFunc(3500*time.Millisecond, func() { backend.WriteToUDP(reply, from) })
+				continue
+			}
+			backend.WriteToUDP(reply, from)
+		}
+	}()
+
+	key := []byte("late-reply-key!!")
+	f, err := server.Forward(backend.LocalAddr().String(), key, server.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	con, err := client.Client("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	if resp, err := client.SendData(con, "127.0.0.1", key, []byte("slow")); err == nil {
+		t.Fatalf("slow request answered in time: %q", resp)
+	}
+	// the late reply is queued at the server by the time the next request
+	// goes out, and goes back ahead of its answer
+	time.Sleep(time.Second)
+	resp, err := client.SendData(con, "127.0.0.1", key, []byte("fast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ECHO: fast" {
+		t.Fatalf("reply = %q, want %q", resp, "ECHO: fast")
+	}
+}
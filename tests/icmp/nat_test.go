@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"icmp-tunnel/icmp/client"
+	"icmp-tunnel/icmp/server"
+)
+
+var natKey = []byte("icmp-nat-key!!!!")
+
+// startAddrBackend answers every datagram with the address it came from.
+func startAddrBackend(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(fmt.Sprintf("%s %s", from, buf[:n])), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// ask sends msg over c and returns the upstream address the backend saw
+// it from, or "" if no reply came.
+func ask(t *testing.T, c *client.Conn, msg string) string {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := c.Read(buf)
+	if err != nil {
+		return ""
+	}
+	from, got, _ := strings.Cut(string(buf[:n]), " ")
+	if got != msg {
+		t.Fatalf("reply to %q is for %q", msg, got)
+	}
+	return from
+}
+
+func TestForwardGivesEverySessionASocket(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	f, err := server.Forward(startAddrBackend(t), natKey, server.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var conns []*client.Conn
+	for range 3 {
+		c, err := client.Dial("127.0.0.1", natKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	// every session keeps its own upstream address
+	seen := make(map[string]int)
+	for round := range 2 {
+		for i, c := range conns {
+			from := ask(t, c, fmt.Sprint("round ", round, " from ", i))
+			if from == "" {
+				t.Fatalf("session %d: no reply", i)
+			}
+			if j, ok := seen[from]; ok && j != i {
+				t.Fatalf("sessions %d and %d share upstream %s", i, j, from)
+			}
+			seen[from] = i
+		}
+	}
+	if len(seen) != len(conns) {
+		t.Fatalf("%d upstream addresses for %d sessions", len(seen), len(conns))
+	}
+}
+
+func TestForwardLimits(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	f, err := server.Forward(startAddrBackend(t), natKey, server.Limits{MaxSessions: 1, Idle: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := client.Dial("127.0.0.1", natKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ask(t, a, "first")
+	if first == "" {
+		t.Fatal("no reply")
+	}
+	b, err := client.Dial("127.0.0.1", natKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if ask(t, b, "over the limit") != "" {
+		t.Fatal("a second session was forwarded past MaxSessions")
+	}
+
+	// once idle, a session gives its place up, here to the other one
+	a.Close()
+	time.Sleep(600 * time.Millisecond)
+	if from := ask(t, b, "after expiry"); from == "" || from == first {
+		t.Fatalf("after expiry: upstream %q, first was %q", from, first)
+	}
+}
+
+func TestForwardQueuesLateDatagrams(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	// the backend answers "twice x" with two datagrams, the second after
+	// the old one second wait, and "late x" after the request would be
+	// stale
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(string(buf[:n]), " ")
+			switch verb {
+			case "twice":
+				backend.WriteToUDP([]byte(arg+" 1"), from)
+				time.AfterFunc(1500*time.Millisecond, func() { backend.WriteToUDP([]byte(arg+" 2"), from) })
+			case "late":
+				time.AfterFunc(4*time.Second, func() { backend.WriteToUDP([]byte(arg), from) })
+			}
+		}
+	}()
+
+	f, err := server.Forward(backend.LocalAddr().String(), natKey, server.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c, err := client.Dial("127.0.0.1", natKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	read := func(timeout time.Duration) string {
+		buf := make([]byte, 65535)
+		c.SetReadDeadline(time.Now().Add(timeout))
+		n, err := c.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+
+	c.Write([]byte("twice a"))
+	for _, want := range []string{"a 1", "a 2"} {
+		if got := read(3 * time.Second); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	// the client's polls keep a fresh request at the server
+	c.Write([]byte("late b"))
+	if got := read(6 * time.Second); got != "b" {
+		t.Fatalf("got %q, want %q", got, "b")
+	}
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"icmp-tunnel/icmp/client"
+	"icmp-tunnel/icmp/server"
+)
+
+func TestProxyForwardsEveryLocalPeer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root for raw ICMP sockets")
+	}
+	f, err := server.Forward(startAddrBackend(t), natKey, server.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := client.ListenProxy("127.0.0.1", "127.0.0.1:0", natKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var peers []*net.UDPConn
+	for range 2 {
+		c, err := net.DialUDP("udp", nil, p.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		peers = append(peers, c)
+	}
+
+	// every local peer gets its own replies, through an upstream of its own
+	seen := make(map[string]int)
+	buf := make([]byte, 65535)
+	for round := range 2 {
+		for i, c := range peers {
+			msg := fmt.Sprint("round ", round, " from ", i)
+			if _, err := c.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatalf("peer %d: %v", i, err)
+			}
+			from, got, _ := strings.Cut(string(buf[:n]), " ")
+			if got != msg {
+				t.Fatalf("peer %d got the reply to %q", i, got)
+			}
+			if j, ok := seen[from]; ok && j != i {
+				t.Fatalf("peers %d and %d share upstream %s", i, j, from)
+			}
+			seen[from] = i
+		}
+	}
+	if len(seen) != len(peers) {
+		t.Fatalf("%d upstream addresses for %d peers", len(seen), len(peers))
+	}
+}
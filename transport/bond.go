@@ -0,0 +1,568 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// Bond frames start with kind(1) and the bond ID(8). A data frame goes on
+// with the message sequence number(8) and the message; an ack frame lists
+// the sequence numbers of the data frames it acknowledges, 8 bytes each. A
+// join frame, the first on every dialed path, carries nothing more.
+const (
+	bondData      = 1
+	bondAck       = 2
+	bondJoin      = 3
+	bondHeaderLen = 1 + 8
+)
+
+const (
+	// bondTick is how often a bond looks for lost messages and stale gaps.
+	bondTick = 20 * time.Millisecond
+	// reorderWait is how long the receiver holds messages behind a gap
+	// before it gives the missing ones up.
+	reorderWait = 300 * time.Millisecond
+	// maxHeld bounds the messages held behind a gap.
+	maxHeld = 1024
+	// initialRTT is assumed for a path until it has been measured.
+	initialRTT = 100 * time.Millisecond
+	// minLossTimeout is the least a message waits for its ack before it
+	// counts as lost; faketcp retransmits on its own within that.
+	minLossTimeout = 250 * time.Millisecond
+	// minShare is the part of the messages the worst path still carries,
+	// so that it is noticed when it recovers.
+	minShare = 0.05
+	// maxAcks bounds the sequence numbers one ack frame carries.
+	maxAcks = 128
+)
+
+// bondJoinTimeout is how long an accepted path has to name its bond.
+var bondJoinTimeout = 10 * time.Second
+
+var errNoPath = errors.New("bond: no path left")
+
+// Bond stripes the messages of one connection over a connection on each
+// of its members at the same time. Paths are weighted by their measured
+// round-trip time and loss, so load shifts away from a path that
+// degrades, and a message lost on one path is sent once more on another.
+// The receiver restores the send order, skipping a gap once it has waited
+// reorderWait for it.
+type Bond struct {
+	Members []Transport
+}
+
+func (b Bond) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	id, err := codec.RandBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	var conns []net.Conn
+	var errs []error
+	for _, m := range b.Members {
+		conn, err := m.Dial(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	c := newBondConn(binary.BigEndian.Uint64(id), conns[0], nil)
+	for _, conn := range conns {
+		c.add(conn, nil)
+	}
+	return c, nil
+}
+
+// Listen accepts a bond per agent, made of the paths it dials on every
+// member.
+func (b Bond) Listen(addr string) (net.Listener, error) {
+	l := &bondListener{
+		accept: make(chan net.Conn, 64),
+		done:   make(chan struct{}),
+		bonds:  make(map[uint64]*bondConn),
+	}
+	for _, m := range b.Members {
+		ln, err := m.Listen(addr)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.lns = append(l.lns, ln)
+	}
+	for _, ln := range l.lns {
+		go l.acceptLoop(ln)
+	}
+	return l, nil
+}
+
+type bondListener struct {
+	lns    []net.Listener
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	bonds map[uint64]*bondConn
+}
+
+func (l *bondListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go l.join(conn)
+	}
+}
+
+// join adds conn as a path to the bond its first frame names, accepting
+// the bond if it is new.
+func (l *bondListener) join(conn net.Conn) {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(bondJoinTimeout))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || n < bondHeaderLen {
+		conn.Close()
+		return
+	}
+	id := binary.BigEndian.Uint64(buf[1:])
+
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c, ok := l.bonds[id]
+	if !ok {
+		c = newBondConn(id, conn, func() {
+			l.mu.Lock()
+			delete(l.bonds, id)
+			l.mu.Unlock()
+		})
+		l.bonds[id] = c
+	}
+	l.mu.Unlock()
+
+	c.add(conn, buf[:n])
+	if !ok {
+		select {
+		case l.accept <- c:
+		case <-l.done:
+		}
+	}
+}
+
+func (l *bondListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops every member listener and closes the bonds accepted so far.
+func (l *bondListener) Close() error {
+	var errs []error
+	l.once.Do(func() {
+		l.mu.Lock()
+		close(l.done)
+		bonds := make([]*bondConn, 0, len(l.bonds))
+		for _, c := range l.bonds {
+			bonds = append(bonds, c)
+		}
+		l.mu.Unlock()
+		for _, ln := range l.lns {
+			errs = append(errs, ln.Close())
+		}
+		for _, c := range bonds {
+			c.Close()
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (l *bondListener) Addr() net.Addr { return l.lns[0].Addr() }
+
+// bondPath is one member connection of a bond.
+type bondPath struct {
+	conn net.Conn
+	acks chan uint64
+
+	// guarded by bondConn.mu
+	srtt    time.Duration
+	loss    float64 // moving average of the lost fraction
+	current float64 // smooth weighted round-robin state
+	dead    bool
+}
+
+func (p *bondPath) lossTimeout() time.Duration {
+	return max(4*p.srtt, minLossTimeout)
+}
+
+// weight is the share of messages p should carry before the minShare floor.
+func (p *bondPath) weight() float64 {
+	return (1 - p.loss) * (1 - p.loss) / p.srtt.Seconds()
+}
+
+// unacked is a data frame waiting for its ack.
+type unacked struct {
+	frame  []byte
+	path   *bondPath
+	sent   time.Time
+	resent bool
+}
+
+type bondConn struct {
+	*msgconn.Conn
+	id      uint64
+	onClose func()
+
+	mu      sync.Mutex
+	paths   []*bondPath
+	seq     uint64
+	unacked map[uint64]*unacked
+	// expect is the next sequence number to deliver; held are the
+	// messages that arrived ahead of it, since heldSince
+	expect    uint64
+	held      map[uint64][]byte
+	heldSince time.Time
+}
+
+// newBondConn returns a bond with no paths yet, addressed like first.
+// onClose, if set, runs once the bond is closed.
+func newBondConn(id uint64, first net.Conn, onClose func()) *bondConn {
+	c := &bondConn{
+		id:      id,
+		onClose: onClose,
+		unacked: make(map[uint64]*unacked),
+		held:    make(map[uint64][]byte),
+	}
+	c.Conn = msgconn.New(first.LocalAddr(), first.RemoteAddr(), c.send, c.shutdown)
+	go c.tickLoop()
+	return c
+}
+
+// add makes conn a path of c. first, if set, is a frame already read from
+// it; otherwise conn was dialed, and names the bond to the server at once so
+// it is kept while no message has been routed to it yet.
+func (c *bondConn) add(conn net.Conn, first []byte) {
+	p := &bondPath{conn: conn, acks: make(chan uint64, maxHeld), srtt: initialRTT}
+	c.mu.Lock()
+	select {
+	case <-c.Done():
+		c.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c.paths = append(c.paths, p)
+	c.mu.Unlock()
+
+	go c.ackLoop(p)
+	if first != nil {
+		c.handle(p, first)
+	} else {
+		c.write(p, c.header(bondJoin, 0))
+	}
+	go c.readLoop(p)
+}
+
+func (c *bondConn) shutdown() error {
+	c.mu.Lock()
+	paths := c.paths
+	c.mu.Unlock()
+	for _, p := range paths {
+		p.conn.Close()
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return nil
+}
+
+func (c *bondConn) header(kind byte, n int) []byte {
+	b := make([]byte, bondHeaderLen, bondHeaderLen+n)
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], c.id)
+	return b
+}
+
+func (c *bondConn) send(msg []byte) error {
+	frame := binary.BigEndian.AppendUint64(c.header(bondData, 8+len(msg)), 0)
+	frame = append(frame, msg...)
+
+	c.mu.Lock()
+	p := c.pick(nil)
+	if p == nil {
+		c.mu.Unlock()
+		return errNoPath
+	}
+	seq := c.seq
+	c.seq++
+	binary.BigEndian.PutUint64(frame[bondHeaderLen:], seq)
+	c.unacked[seq] = &unacked{frame: frame, path: p, sent: time.Now()}
+	c.mu.Unlock()
+
+	c.write(p, frame)
+	return nil
+}
+
+// write sends frame on p. A failed path is dropped; the frame is resent on
+// another one once it counts as lost.
+func (c *bondConn) write(p *bondPath, frame []byte) {
+	if _, err := p.conn.Write(frame); err != nil {
+		c.drop(p, err)
+	}
+}
+
+// pick chooses the path for the next message by smooth weighted
+// round-robin, avoiding the path not unless it is the only one left.
+// c.mu must be held.
+func (c *bondConn) pick(not *bondPath) *bondPath {
+	var live []*bondPath
+	for _, p := range c.paths {
+		if !p.dead && p != not {
+			live = append(live, p)
+		}
+	}
+	if len(live) == 0 {
+		if not == nil || not.dead {
+			return nil
+		}
+		return not
+	}
+
+	var total float64
+	for _, p := range live {
+		total += p.weight()
+	}
+	var best *bondPath
+	var sum float64
+	for _, p := range live {
+		w := max(p.weight(), minShare*total)
+		sum += w
+		p.current += w
+		if best == nil || p.current > best.current {
+			best = p
+		}
+	}
+	best.current -= sum
+	return best
+}
+
+func (c *bondConn) readLoop(p *bondPath) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			c.drop(p, err)
+			return
+		}
+		c.handle(p, buf[:n])
+	}
+}
+
+func (c *bondConn) handle(p *bondPath, frame []byte) {
+	if len(frame) < bondHeaderLen || binary.BigEndian.Uint64(frame[1:]) != c.id {
+		return
+	}
+	body := frame[bondHeaderLen:]
+	switch frame[0] {
+	case bondData:
+		if len(body) < 8 {
+			return
+		}
+		seq := binary.BigEndian.Uint64(body)
+		select {
+		case p.acks <- seq:
+		default:
+		}
+		c.receive(seq, append([]byte(nil), body[8:]...))
+	case bondAck:
+		now := time.Now()
+		c.mu.Lock()
+		for ; len(body) >= 8; body = body[8:] {
+			seq := binary.BigEndian.Uint64(body)
+			m, ok := c.unacked[seq]
+			if !ok {
+				continue
+			}
+			delete(c.unacked, seq)
+			m.path.loss *= 0.9
+			if !m.resent {
+				m.path.srtt += (now.Sub(m.sent) - m.path.srtt) / 8
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// ackLoop acknowledges the data frames received on p, batching the ones
+// that queue up while an ack frame is being written.
+func (c *bondConn) ackLoop(p *bondPath) {
+	for {
+		var seq uint64
+		select {
+		case seq = <-p.acks:
+		case <-c.Done():
+			return
+		}
+		frame := binary.BigEndian.AppendUint64(c.header(bondAck, 8), seq)
+	batch:
+		for len(frame) < bondHeaderLen+8*maxAcks {
+			select {
+			case seq = <-p.acks:
+				frame = binary.BigEndian.AppendUint64(frame, seq)
+			default:
+				break batch
+			}
+		}
+		if _, err := p.conn.Write(frame); err != nil {
+			c.drop(p, err)
+			return
+		}
+	}
+}
+
+// receive delivers msg in sequence order.
+func (c *bondConn) receive(seq uint64, msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case seq < c.expect:
+		// a duplicate of a resent message
+	case seq == c.expect:
+		c.Deliver(msg)
+		c.expect++
+		c.release(time.Now())
+	default:
+		if _, dup := c.held[seq]; dup {
+			return
+		}
+		if len(c.held) == 0 {
+			c.heldSince = time.Now()
+		}
+		c.held[seq] = msg
+		if len(c.held) >= maxHeld {
+			c.skip(time.Now())
+		}
+	}
+}
+
+// release delivers the held messages that are next in order. c.mu must be
+// held.
+func (c *bondConn) release(now time.Time) {
+	for {
+		msg, ok := c.held[c.expect]
+		if !ok {
+			break
+		}
+		delete(c.held, c.expect)
+		c.Deliver(msg)
+		c.expect++
+	}
+	if len(c.held) > 0 {
+		// a new gap opens
+		c.heldSince = now
+	}
+}
+
+// skip gives up the messages missing before the first held one. c.mu must
+// be held.
+func (c *bondConn) skip(now time.Time) {
+	seqs := make([]uint64, 0, len(c.held))
+	for seq := range c.held {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	c.expect = seqs[0]
+	c.release(now)
+}
+
+// tickLoop resends the messages lost on one path on another and skips
+// gaps the receiver waited long enough for.
+func (c *bondConn) tickLoop() {
+	tick := time.NewTicker(bondTick)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-c.Done():
+			return
+		}
+
+		type resend struct {
+			p     *bondPath
+			frame []byte
+		}
+		var out []resend
+		c.mu.Lock()
+		for seq, m := range c.unacked {
+			if now.Sub(m.sent) < m.path.lossTimeout() {
+				continue
+			}
+			m.path.loss = m.path.loss*0.9 + 0.1
+			if m.resent {
+				delete(c.unacked, seq)
+				continue
+			}
+			p := c.pick(m.path)
+			if p == nil {
+				delete(c.unacked, seq)
+				continue
+			}
+			m.path, m.sent, m.resent = p, now, true
+			out = append(out, resend{p, m.frame})
+		}
+		if len(c.held) > 0 && now.Sub(c.heldSince) >= reorderWait {
+			c.skip(now)
+		}
+		c.mu.Unlock()
+
+		for _, r := range out {
+			c.write(r.p, r.frame)
+		}
+	}
+}
+
+// drop takes p out of service and closes the bond when no path is left.
+func (c *bondConn) drop(p *bondPath, err error) {
+	c.mu.Lock()
+	if p.dead {
+		c.mu.Unlock()
+		return
+	}
+	p.dead = true
+	live := 0
+	for _, q := range c.paths {
+		if !q.dead {
+			live++
+		}
+	}
+	c.mu.Unlock()
+	p.conn.Close()
+	if live == 0 {
+		if errors.Is(err, net.ErrClosed) {
+			err = io.EOF
+		}
+		c.CloseWithError(err)
+	}
+}
@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPath is a bond member on its own UDP port whose dialed conns count
+// their writes and, if lossy, drop every other one.
+type testPath struct {
+	UDP
+	addr   string
+	lossy  bool
+	writes *atomic.Int64
+}
+
+func newTestPath(t *testing.T, lossy bool) testPath {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return testPath{addr: addr, lossy: lossy, writes: new(atomic.Int64)}
+}
+
+func (p testPath) Dial(ctx context.Context, _ string) (net.Conn, error) {
+	c, err := p.UDP.Dial(ctx, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c, p: p}, nil
+}
+
+func (p testPath) Listen(string) (net.Listener, error) { return p.UDP.Listen(p.addr) }
+
+type countingConn struct {
+	net.Conn
+	p testPath
+	n atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.p.writes.Add(1)
+	if c.p.lossy && c.n.Add(1)%2 == 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func bondPair(t *testing.T, paths ...testPath) net.Conn {
+	var b Bond
+	for _, p := range paths {
+		b.Members = append(b.Members, p)
+	}
+	l, err := b.Listen("")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	echo(t, l)
+	c, err := b.Dial(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// stream writes n numbered messages and checks they all come back in order.
+func stream(t *testing.T, c net.Conn, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			c.Write([]byte(fmt.Sprintf("message %d", i)))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	defer wg.Wait()
+	buf := make([]byte, 65536)
+	for i := 0; i < n; i++ {
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		m, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("message %d", i); string(buf[:m]) != want {
+			t.Fatalf("got %q, want %q", buf[:m], want)
+		}
+	}
+}
+
+func TestBondStripesInOrder(t *testing.T) {
+	a, b := newTestPath(t, false), newTestPath(t, false)
+	c := bondPair(t, a, b)
+	stream(t, c, 300)
+	if a.writes.Load() == 0 || b.writes.Load() == 0 {
+		t.Fatalf("traffic not striped: %d and %d writes", a.writes.Load(), b.writes.Load())
+	}
+}
+
+func TestBondShiftsLoadFromLossyPath(t *testing.T) {
+	good, lossy := newTestPath(t, false), newTestPath(t, true)
+	c := bondPair(t, good, lossy)
+	// every message arrives, the ones lost on one path resent on the other
+	stream(t, c, 300)
+	if g, l := good.writes.Load(), lossy.writes.Load(); l*2 > g {
+		t.Fatalf("lossy path carried %d writes against %d", l, g)
+	}
+}
+
+func TestBondSurvivesLostPath(t *testing.T) {
+	a, b := newTestPath(t, false), newTestPath(t, false)
+	c := bondPair(t, a, b)
+	stream(t, c, 10)
+
+	bc := c.(*bondConn)
+	bc.mu.Lock()
+	first := bc.paths[0]
+	bc.mu.Unlock()
+	first.conn.Close()
+	stream(t, c, 50)
+}
+
+func TestBondKeepsIdlePaths(t *testing.T) {
+	defer func(old time.Duration) { bondJoinTimeout = old }(bondJoinTimeout)
+	bondJoinTimeout = 100 * time.Millisecond
+
+	a, b := newTestPath(t, false), newTestPath(t, false)
+	l, err := Bond{Members: []Transport{a, b}}.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, l)
+	c, err := Bond{Members: []Transport{a, b}}.Dial(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// no message goes out before both paths would have timed out joining
+	time.Sleep(3 * bondJoinTimeout)
+	l.(*bondListener).mu.Lock()
+	s := l.(*bondListener).bonds[c.(*bondConn).id]
+	l.(*bondListener).mu.Unlock()
+	if s == nil {
+		t.Fatal("server dropped the bond")
+	}
+	s.mu.Lock()
+	live := 0
+	for _, p := range s.paths {
+		if !p.dead {
+			live++
+		}
+	}
+	s.mu.Unlock()
+	if live != 2 {
+		t.Fatalf("server kept %d of 2 paths", live)
+	}
+
+	wa, wb := a.writes.Load(), b.writes.Load()
+	stream(t, c, 100)
+	if a.writes.Load() == wa || b.writes.Load() == wb {
+		t.Fatalf("traffic not striped after idling: %d and %d writes", a.writes.Load()-wa, b.writes.Load()-wb)
+	}
+}
@@ -0,0 +1,26 @@
+package transport
+
+import (
+	"context"
+	"net"
+
+	"icmp-tunnel/dns"
+)
+
+// DNS carries messages in DNS queries to the server, as the authoritative
+// name server of the tunnel domain, and in the records answering them.
+type DNS struct {
+	dns.Options
+}
+
+// Dial opens a tunnel through a resolver. addr is "domain@resolver",
+// a bare "domain" for the system resolver, or the "host:port" of the
+// server itself.
+func (t DNS) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return dns.Dial(ctx, addr, t.Options)
+}
+
+// Listen serves DNS on addr, port 53 unless it names one.
+func (t DNS) Listen(addr string) (net.Listener, error) {
+	return dns.Listen(withPort(addr, "53"), t.Options)
+}
@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"icmp-tunnel/icmp/client"
+	"icmp-tunnel/icmp/server"
+)
+
+// ICMP carries messages in echo requests from the agent and echo replies
+// from the server, which can only write in answer to a request.
+type ICMP struct {
+	Key []byte
+}
+
+// Dial opens a tunnel to the host of addr, over ICMPv6 if it is an IPv6
+// address; any port is ignored.
+func (t ICMP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return client.Dial(hostOnly(addr), t.Key)
+}
+
+// Listen accepts a conn per client session. The address is ignored: ICMP
+// has no ports and the listener answers on every interface, over IPv4 and
+// ICMPv6.
+func (t ICMP) Listen(addr string) (net.Listener, error) {
+	return server.Listen(t.Key)
+}
+
+// hostOnly strips a port from addr, which ICMP has no use for.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"icmp-tunnel/config"
+	"icmp-tunnel/dns"
+	"icmp-tunnel/faketcp"
+	"icmp-tunnel/web"
+)
+
+// Factory builds a transport for a URL of the scheme it is registered
+// under. key is the resolved key from the URL, nil if it names none; the
+// remaining query parameters are the factory's to read.
+type Factory func(key []byte, u *url.URL) (Transport, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+func init() {
+	Register("icmp", func(key []byte, u *url.URL) (Transport, error) {
+		if key == nil {
+			return nil, errors.New("icmp: key is required")
+		}
+		return ICMP{Key: key}, nil
+	})
+	Register("faketcp", fakeTCP(false))
+	Register("faketcp-raw", fakeTCP(true))
+	Register("udp", func(key []byte, u *url.URL) (Transport, error) {
+		return UDP{Key: key}, nil
+	})
+	Register("dns", func(key []byte, u *url.URL) (Transport, error) {
+		if key == nil {
+			return nil, errors.New("dns: key is required")
+		}
+		opts := dns.Options{Key: key}
+		switch record := u.Query().Get("record"); record {
+		case "", "txt":
+		case "null":
+			opts.NULL = true
+		default:
+			return nil, fmt.Errorf("dns: unknown record type %q (want \"txt\" or \"null\")", record)
+		}
+		return DNS{opts}, nil
+	})
+	Register("http", func(key []byte, u *url.URL) (Transport, error) {
+		if key == nil {
+			return nil, errors.New("http: key is required")
+		}
+		q := u.Query()
+		opts := web.Options{Key: key, Path: u.Path, Mode: q.Get("mode"), Proxy: q.Get("proxy")}
+		switch opts.Mode {
+		case "", "ws", "poll":
+		default:
+			return nil, fmt.Errorf("http: unknown mode %q (want \"ws\" or \"poll\")", opts.Mode)
+		}
+		return Web{opts}, nil
+	})
+}
+
+// fakeTCP builds faketcp transports, over UDP or in genuine TCP segments
+// on a raw socket.
+func fakeTCP(raw bool) Factory {
+	return func(key []byte, u *url.URL) (Transport, error) {
+		opts := faketcp.Options{Key: key, Raw: raw}
+		q := u.Query()
+		var err error
+		if v := q.Get("handshake_timeout"); v != "" {
+			if opts.HandshakeTimeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%s: handshake_timeout: %v", u.Scheme, err)
+			}
+		}
+		if v := q.Get("retries"); v != "" {
+			if opts.Retries, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%s: retries: %v", u.Scheme, err)
+			}
+		}
+		return FakeTCP{opts}, nil
+	}
+}
+
+// Register makes a transport available under scheme to New, Dial and
+// Listen, and as a transport in config files. It panics if scheme is
+// already registered. Call it from an init function.
+func Register(scheme string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[scheme]; dup {
+		panic("transport: Register called twice for " + scheme)
+	}
+	registry[scheme] = f
+	if !slices.Contains(config.Transports, scheme) {
+		config.Transports = append(config.Transports, scheme)
+	}
+}
+
+// Schemes returns the registered transport names, sorted.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var out []string
+	for s := range registry {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// lookup returns the factory for scheme. A scheme joining several names
+// with "+", such as "icmp+faketcp", bonds those transports.
+func lookup(scheme string) (Factory, error) {
+	if names := strings.Split(scheme, "+"); len(names) > 1 {
+		var members []Factory
+		for _, name := range names {
+			f, err := lookup(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, f)
+		}
+		return func(key []byte, u *url.URL) (Transport, error) {
+			var b Bond
+			for _, f := range members {
+				tr, err := f(key, u)
+				if err != nil {
+					return nil, err
+				}
+				b.Members = append(b.Members, tr)
+			}
+			return b, nil
+		}, nil
+	}
+	registryMu.RLock()
+	f, ok := registry[scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q (registered: %q)", scheme, Schemes())
+	}
+	return f, nil
+}
+
+// Parse returns the transport a URL such as "icmp://10.0.0.1?key=hex:..."
+// or "icmp+faketcp://10.0.0.1:4000?key=hex:..." names and the address to
+// dial or listen on. The key comes from the key, key_file or key_env query
+// parameter, optionally stretched with kdf=scrypt|argon2id and kdf_salt,
+// as in the config file.
+func Parse(rawURL string) (Transport, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme == "" {
+		return nil, "", fmt.Errorf("%q has no transport scheme", rawURL)
+	}
+	f, err := lookup(u.Scheme)
+	if err != nil {
+		return nil, "", err
+	}
+	q := u.Query()
+	ks := config.KeySource{
+		Key:     q.Get("key"),
+		KeyFile: q.Get("key_file"),
+		KeyEnv:  q.Get("key_env"),
+		KDF:     config.KDF{Algorithm: q.Get("kdf"), Salt: q.Get("kdf_salt")},
+	}
+	var key []byte
+	if ks.Key != "" || ks.KeyFile != "" || ks.KeyEnv != "" {
+		if key, err = ks.ResolveKey(); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", u.Scheme, err)
+		}
+	}
+	tr, err := f(key, u)
+	if err != nil {
+		return nil, "", err
+	}
+	return tr, u.Host, nil
+}
+
+// Dial connects through the transport rawURL names to the server it
+// addresses, e.g. "faketcp://10.0.0.1:4000?key=hex:...".
+func Dial(ctx context.Context, rawURL string) (net.Conn, error) {
+	tr, addr, err := Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return tr.Dial(ctx, addr)
+}
+
+// Listen accepts connections on the transport and address rawURL names.
+func Listen(rawURL string) (net.Listener, error) {
+	tr, addr, err := Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return tr.Listen(addr)
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "hex:000102030405060708090a0b0c0d0e0f"
+
+// echo answers every message on every conn l accepts.
+func echo(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 65536)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65536)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Fatalf("echo = %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestDialURL(t *testing.T) {
+	for _, query := range []string{"", "?key=" + testKey} {
+		for _, scheme := range []string{"udp", "faketcp"} {
+			if scheme == "faketcp" && query == "" {
+				continue
+			}
+			t.Run(scheme+query, func(t *testing.T) {
+				l, err := Listen(scheme + "://127.0.0.1:0" + query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, l)
+				c, err := Dial(context.Background(), scheme+"://"+l.Addr().String()+query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				roundTrip(t, c, "hello "+scheme)
+			})
+		}
+	}
+}
+
+func TestDialURLErrors(t *testing.T) {
+	for _, u := range []string{
+		"10.0.0.1",
+		"carrier-pigeon://10.0.0.1",
+		"icmp://10.0.0.1",
+		"faketcp://10.0.0.1?key=short",
+		"faketcp://10.0.0.1?key=" + testKey + "&retries=many",
+	} {
+		if _, err := Dial(context.Background(), u); err == nil {
+			t.Errorf("Dial(%q): want error", u)
+		}
+	}
+}
+
+// loud is a third-party transport: UDP that upper-cases what it sends.
+type loud struct{ UDP }
+
+type loudConn struct{ net.Conn }
+
+func (c loudConn) Write(b []byte) (int, error) {
+	return c.Conn.Write([]byte(strings.ToUpper(string(b))))
+}
+
+func (t loud) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := t.UDP.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return loudConn{c}, nil
+}
+
+func TestRegister(t *testing.T) {
+	Register("loud", func(key []byte, u *url.URL) (Transport, error) {
+		return loud{UDP{Key: key}}, nil
+	})
+	if !strings.Contains(fmt.Sprint(Schemes()), "loud") {
+		t.Fatalf("Schemes() = %q", Schemes())
+	}
+	l, err := Listen("udp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, l)
+	c, err := Dial(context.Background(), "loud://"+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("quiet"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "QUIET" {
+		t.Fatalf("read = %q, %v", buf[:n], err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a scheme twice did not panic")
+		}
+	}()
+	Register("loud", nil)
+}
@@ -0,0 +1,60 @@
+// Package transport defines the carriers a tunnel runs over.
+//
+// A Transport dials a server or listens for agents and hands back
+// message-oriented connections: every Write is delivered as a single Read
+// on the other side, or lost, like a connected UDP socket. Forwarding,
+// SOCKS, metrics and tests are written once against net.Conn and run over
+// any carrier.
+package transport
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"icmp-tunnel/faketcp"
+)
+
+// Transport carries messages between agents and a server.
+type Transport interface {
+	// Dial connects to the server at addr.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Listen accepts agent connections on addr. Carriers without ports
+	// ignore the port of addr.
+	Listen(addr string) (net.Listener, error)
+}
+
+// New returns the transport registered as name, authenticated and sealed
+// with key.
+func New(name string, key []byte) (Transport, error) {
+	f, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f(key, &url.URL{Scheme: name})
+}
+
+// FakeTCP carries messages in faketcp segments, over UDP or, with Raw set,
+// as genuine TCP segments on a raw socket.
+type FakeTCP struct {
+	faketcp.Options
+}
+
+// DefaultFakeTCPPort is used when a faketcp address has no port.
+const DefaultFakeTCPPort = "4000"
+
+func (t FakeTCP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return faketcp.Dial(ctx, withPort(addr, DefaultFakeTCPPort), t.Options)
+}
+
+func (t FakeTCP) Listen(addr string) (net.Listener, error) {
+	return faketcp.Listen(withPort(addr, DefaultFakeTCPPort), t.Options)
+}
+
+// withPort adds port to addr unless it has one already.
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// udpIdle closes listener conns whose peer sent nothing for that long.
+const udpIdle = 5 * time.Minute
+
+// UDP carries every message in one plain UDP datagram, sealed with AES-GCM
+// when Key is set. It is the carrier for networks that pass UDP as is.
+type UDP struct {
+	Key []byte
+}
+
+func (t UDP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil || t.Key == nil {
+		return c, err
+	}
+	return &sealedConn{Conn: c, key: t.Key}, nil
+}
+
+// sealedConn seals the datagrams of a connected UDP socket, dropping the
+// ones that fail to open.
+type sealedConn struct {
+	net.Conn
+	key []byte
+	buf [65536]byte
+}
+
+func (c *sealedConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(c.buf[:])
+		if err != nil {
+			return 0, err
+		}
+		msg, err := codec.DecryptAES(c.key, c.buf[:n])
+		if err == nil {
+			return copy(b, msg), nil
+		}
+	}
+}
+
+func (c *sealedConn) Write(b []byte) (int, error) {
+	sealed, err := codec.EncryptAES(c.key, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Listen accepts a conn per peer address on the UDP socket addr.
+func (t UDP) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		pc:     pc,
+		key:    t.Key,
+		accept: make(chan net.Conn, 64),
+		done:   make(chan struct{}),
+		peers:  make(map[string]*udpPeer),
+	}
+	go l.run()
+	return l, nil
+}
+
+type udpListener struct {
+	pc     *net.UDPConn
+	key    []byte
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	peers map[string]*udpPeer
+}
+
+type udpPeer struct {
+	*msgconn.Conn
+	lastSeen time.Time
+}
+
+func (l *udpListener) run() {
+	tick := time.NewTicker(udpIdle / 4)
+	defer tick.Stop()
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := l.pc.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		if l.key != nil {
+			if msg, err = codec.DecryptAES(l.key, msg); err != nil {
+				continue
+			}
+		}
+		if p := l.peer(raddr); p != nil {
+			p.Deliver(msg)
+		}
+
+		select {
+		case now := <-tick.C:
+			l.expire(now)
+		default:
+		}
+	}
+}
+
+// peer returns the conn of raddr, starting one if there is none. It
+// returns nil if the accept backlog is full.
+func (l *udpListener) peer(raddr *net.UDPAddr) *udpPeer {
+	key := raddr.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p, ok := l.peers[key]; ok {
+		p.lastSeen = time.Now()
+		return p
+	}
+	p := &udpPeer{lastSeen: time.Now()}
+	p.Conn = msgconn.New(l.pc.LocalAddr(), raddr, func(b []byte) error {
+		if l.key != nil {
+			sealed, err := codec.EncryptAES(l.key, b)
+			if err != nil {
+				return err
+			}
+			b = sealed
+		}
+		_, err := l.pc.WriteToUDP(b, raddr)
+		return err
+	}, func() error {
+		l.mu.Lock()
+		if l.peers[key] == p {
+			delete(l.peers, key)
+		}
+		l.mu.Unlock()
+		return nil
+	})
+	select {
+	case l.accept <- p:
+	default:
+		return nil
+	}
+	l.peers[key] = p
+	return p
+}
+
+func (l *udpListener) expire(now time.Time) {
+	l.mu.Lock()
+	var idle []*udpPeer
+	for _, p := range l.peers {
+		if now.Sub(p.lastSeen) > udpIdle {
+			idle = append(idle, p)
+		}
+	}
+	l.mu.Unlock()
+	for _, p := range idle {
+		p.Close()
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.pc.Close()
+		l.mu.Lock()
+		peers := l.peers
+		l.peers = make(map[string]*udpPeer)
+		l.mu.Unlock()
+		for _, p := range peers {
+			p.Close()
+		}
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr { return l.pc.LocalAddr() }
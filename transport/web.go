@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"context"
+	"net"
+
+	"icmp-tunnel/web"
+)
+
+// Web carries messages over HTTP: in WebSocket messages, or in long
+// polling requests where WebSockets do not get through.
+type Web struct {
+	web.Options
+}
+
+// Dial connects to the server at addr, port 80 unless it names one,
+// through the proxy of the options or the environment.
+func (t Web) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return web.Dial(ctx, withPort(addr, "80"), t.Options)
+}
+
+// Listen serves HTTP on addr, port 80 unless it names one.
+func (t Web) Listen(addr string) (net.Listener, error) {
+	return web.Listen(withPort(addr, "80"), t.Options)
+}
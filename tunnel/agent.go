@@ -0,0 +1,345 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/config"
+	"icmp-tunnel/transport"
+)
+
+const (
+	// maxChunk bounds how much stream data one request carries upstream.
+	maxChunk = 16 * 1024
+	// maxDatagram is the largest UDP datagram carried either way.
+	maxDatagram = 65535
+	// TCP flows poll the server for downstream data between pollMin and
+	// pollMax, backing off while neither side has anything to say.
+	pollMin = 20 * time.Millisecond
+	pollMax = time.Second
+	// udpFlowIdle is how long an agent remembers a silent UDP peer.
+	udpFlowIdle = 2 * time.Minute
+)
+
+// Agent forwards local ports through the tunnel.
+type Agent struct {
+	name string
+	rt   roundTripper
+	conn io.Closer
+
+	mu       sync.Mutex
+	forwards map[forward]func()
+	// sockets holds the socket of every running UDP forward
+	sockets map[forward]*udpSocket
+}
+
+// forward identifies one running listener.
+type forward struct {
+	proto uint8
+	m     config.PortMapping
+}
+
+// NewAgent listens on the local side of every port mapping of t and
+// forwards traffic to t.Server over the first of t.Transport that works.
+func NewAgent(t *config.Tunnel) (*Agent, error) {
+	if t.Server == "" {
+		return nil, errors.New("agent: server address is not set")
+	}
+	key, err := t.Secret()
+	if err != nil {
+		return nil, err
+	}
+	var carriers []carrier
+	for _, name := range t.TransportList() {
+		tr, err := transport.New(name, key)
+		if err != nil {
+			return nil, err
+		}
+		carriers = append(carriers, carrier{name, tr})
+	}
+	if len(carriers) == 0 {
+		return nil, errors.New("agent: no transport is set")
+	}
+
+	sel := newSelector(t.Server, carriers, func(format string, args ...any) {
+		log.Printf("[%s] agent: "+format, append([]any{t.Name}, args...)...)
+	})
+	ex := newExchanger(sel.dial)
+	if len(carriers) > 1 {
+		go sel.reprobe(ex)
+	}
+	a := newAgent(t.Name, ex.roundTrip)
+	a.conn = ex
+	if err := a.Reload(t); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func newAgent(name string, rt roundTripper) *Agent {
+	return &Agent{
+		name:     name,
+		rt:       rt,
+		forwards: make(map[forward]func()),
+		sockets:  make(map[forward]*udpSocket),
+	}
+}
+
+// Reload starts listeners for mappings added to t and drains the ones it
+// no longer lists: they stop accepting, while connections and datagrams
+// already in flight run to completion. Unchanged mappings are not touched.
+// A UDP mapping that keeps its local address keeps its socket too, since it
+// could not be bound again while the old one drains. Other settings only
+// take effect on restart.
+func (a *Agent) Reload(t *config.Tunnel) error {
+	proto, err := protoByName(t.Type)
+	if err != nil {
+		return err
+	}
+	mappings, err := config.ParsePorts(t.Ports)
+	if err != nil {
+		return err
+	}
+	want := make(map[forward]bool, len(mappings))
+	for _, m := range mappings {
+		want[forward{proto, m}] = true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	handoff := make(map[string]*udpSocket)
+	for f, stop := range a.forwards {
+		if !want[f] {
+			a.logf("draining %s %s", protoName(f.proto), f.m)
+			if pc, ok := a.sockets[f]; ok {
+				pc.acquire()
+				handoff[f.m.Local()] = pc
+				delete(a.sockets, f)
+			}
+			stop()
+			delete(a.forwards, f)
+		}
+	}
+	defer func() {
+		for _, pc := range handoff {
+			pc.release()
+		}
+	}()
+	var errs []error
+	for _, m := range mappings {
+		f := forward{proto, m}
+		if _, ok := a.forwards[f]; ok {
+			continue
+		}
+		stop, err := a.start(f, handoff[m.Local()])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("[%s] agent: %s %s: %w", a.name, protoName(proto), m, err))
+			continue
+		}
+		a.logf("forwarding %s %s", protoName(proto), m)
+		a.forwards[f] = stop
+	}
+	return errors.Join(errs...)
+}
+
+// Close drains every listener and releases the tunnel socket.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for f, stop := range a.forwards {
+		stop()
+		delete(a.forwards, f)
+		delete(a.sockets, f)
+	}
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
+
+func (a *Agent) logf(format string, args ...any) {
+	log.Printf("[%s] agent: "+format, append([]any{a.name}, args...)...)
+}
+
+// start opens the listener for f, or serves a UDP forward on pc if it is
+// not nil, and returns the function draining it. Once that returns, nothing
+// reads the socket any more.
+func (a *Agent) start(f forward, pc *udpSocket) (stop func(), err error) {
+	if f.proto == protoUDP {
+		if pc == nil {
+			conn, err := net.ListenPacket("udp", f.m.Local())
+			if err != nil {
+				return nil, err
+			}
+			pc = &udpSocket{PacketConn: conn}
+		}
+		pc.acquire()
+		a.sockets[f] = pc
+		quit, stopped := make(chan struct{}), make(chan struct{})
+		go a.serveUDP(pc, f.m, quit, stopped)
+		return func() {
+			close(quit)
+			pc.SetReadDeadline(time.Now())
+			<-stopped
+			pc.SetReadDeadline(time.Time{})
+		}, nil
+	}
+	ln, err := net.Listen("tcp", f.m.Local())
+	if err != nil {
+		return nil, err
+	}
+	go a.serveTCP(ln, f.m)
+	return func() { ln.Close() }, nil
+}
+
+func (a *Agent) send(r request) (status uint8, data []byte, err error) {
+	reply, err := a.rt(marshalRequest(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply) < 1 {
+		return 0, nil, errors.New("empty reply")
+	}
+	return reply[0], reply[1:], nil
+}
+
+// serveTCP accepts until ln is closed; accepted connections outlive it.
+func (a *Agent) serveTCP(ln net.Listener, m config.PortMapping) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.logf("tcp %s: %v", m, err)
+			}
+			return
+		}
+		go a.pipeTCP(conn, m)
+	}
+}
+
+// pipeTCP carries one local connection as a flow, pushing whatever the
+// local side wrote and polling for what the remote side sent back.
+func (a *Agent) pipeTCP(conn net.Conn, m config.PortMapping) {
+	defer conn.Close()
+	flow := newFlowID()
+	closeReq := request{op: opClose, proto: protoTCP, flow: flow, port: m.RemotePort, host: m.RemoteHost}
+	buf := make([]byte, maxChunk)
+	wait := pollMin
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(buf)
+		if err != nil && !isTimeout(err) {
+			_, _, _ = a.send(closeReq)
+			return
+		}
+		status, data, err := a.send(request{op: opData, proto: protoTCP, flow: flow, port: m.RemotePort, host: m.RemoteHost, data: buf[:n]})
+		if err != nil {
+			a.logf("tcp flow %08x: %v", flow, err)
+			return
+		}
+		if len(data) > 0 {
+			if _, err := conn.Write(data); err != nil {
+				_, _, _ = a.send(closeReq)
+				return
+			}
+		}
+		if status != statusOK {
+			return
+		}
+		if n > 0 || len(data) > 0 {
+			wait = pollMin
+		} else if wait *= 2; wait > pollMax {
+			wait = pollMax
+		}
+	}
+}
+
+// udpSocket is the socket of a UDP forward, closed once the last forward
+// reading it and the replies they have in flight are done.
+type udpSocket struct {
+	net.PacketConn
+
+	mu    sync.Mutex
+	users int
+}
+
+func (s *udpSocket) acquire() {
+	s.mu.Lock()
+	s.users++
+	s.mu.Unlock()
+}
+
+func (s *udpSocket) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users--; s.users == 0 {
+		s.PacketConn.Close()
+	}
+}
+
+type udpFlow struct {
+	id       uint32
+	lastSeen time.Time
+}
+
+// serveUDP relays datagrams until quit is closed, then closes stopped and
+// waits for the replies still in flight before releasing pc.
+func (a *Agent) serveUDP(pc *udpSocket, m config.PortMapping, quit <-chan struct{}, stopped chan<- struct{}) {
+	var inflight sync.WaitGroup
+	defer func() {
+		close(stopped)
+		inflight.Wait()
+		pc.release()
+	}()
+
+	flows := make(map[string]*udpFlow)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-quit:
+			default:
+				a.logf("udp %s: %v", m, err)
+			}
+			return
+		}
+		now := time.Now()
+		f, ok := flows[peer.String()]
+		if !ok {
+			f = &udpFlow{id: newFlowID()}
+			flows[peer.String()] = f
+		}
+		f.lastSeen = now
+		for k, v := range flows {
+			if now.Sub(v.lastSeen) > udpFlowIdle {
+				delete(flows, k)
+			}
+		}
+
+		data := append([]byte(nil), buf[:n]...)
+		inflight.Add(1)
+		go func(id uint32) {
+			defer inflight.Done()
+			status, reply, err := a.send(request{op: opData, proto: protoUDP, flow: id, port: m.RemotePort, host: m.RemoteHost, data: data})
+			if err != nil {
+				a.logf("udp flow %08x: %v", id, err)
+				return
+			}
+			if status == statusOK && len(reply) > 0 {
+				_, _ = pc.WriteTo(reply, peer)
+			}
+		}(f.id)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
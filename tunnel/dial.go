@@ -0,0 +1,25 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+
+	"icmp-tunnel/transport"
+)
+
+// Dial connects to a server through the transport rawURL names:
+//
+//	icmp://10.0.0.1?key=hex:...
+//	faketcp://10.0.0.1:4000?key_file=/etc/tunnel/key
+//	udp://10.0.0.1:5000
+//
+// The returned conn carries one message per Write. Transports registered
+// with transport.Register are available under their scheme.
+func Dial(ctx context.Context, rawURL string) (net.Conn, error) {
+	return transport.Dial(ctx, rawURL)
+}
+
+// Listen accepts connections on the transport and address rawURL names.
+func Listen(rawURL string) (net.Listener, error) {
+	return transport.Listen(rawURL)
+}
@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/transport"
+)
+
+const (
+	// probeTimeout bounds one probe of a transport.
+	probeTimeout = 2 * time.Second
+	// reprobeInterval is how often an agent that fell back checks whether
+	// a transport it prefers works again.
+	reprobeInterval = 30 * time.Second
+)
+
+type carrier struct {
+	name string
+	tr   transport.Transport
+}
+
+// selector picks the transport an agent talks to its server over: the
+// first of its carriers, in priority order, that passes a probe. A probe
+// dials the carrier, which for faketcp is the SYN/SYN|ACK handshake, and
+// runs one ping exchange, which for ICMP is an echo round trip.
+type selector struct {
+	server   string
+	carriers []carrier
+	logf     func(format string, args ...any)
+
+	mu sync.Mutex
+	// active is the index of the carrier in use, -1 before the first dial
+	active int
+}
+
+func newSelector(server string, carriers []carrier, logf func(string, ...any)) *selector {
+	return &selector{server: server, carriers: carriers, logf: logf, active: -1}
+}
+
+func (s *selector) probe(c carrier) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	conn, err := c.tr.Dial(ctx, s.server)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchange(conn, 0, marshalRequest(request{op: opPing}), probeTimeout)
+	if err == nil && (len(reply) == 0 || reply[0] != statusOK) {
+		err = errors.New("unexpected ping reply")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial is the exchanger's dial function.
+func (s *selector) dial() (net.Conn, error) {
+	if len(s.carriers) == 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+		defer cancel()
+		return s.carriers[0].tr.Dial(ctx, s.server)
+	}
+	var errs []error
+	for i, c := range s.carriers {
+		conn, err := s.probe(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", c.name, err))
+			continue
+		}
+		s.use(i)
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no transport reaches %s: %w", s.server, errors.Join(errs...))
+}
+
+func (s *selector) use(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != i {
+		s.logf("using %s to %s", s.carriers[i].name, s.server)
+		s.active = i
+	}
+}
+
+// reprobe moves ex back to a preferred carrier once it passes a probe
+// again, until ex is closed.
+func (s *selector) reprobe(ex *exchanger) {
+	tick := time.NewTicker(reprobeInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ex.done:
+			return
+		}
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		for i := 0; i < active; i++ {
+			conn, err := s.probe(s.carriers[i])
+			if err != nil {
+				continue
+			}
+			if ex.swap(conn) {
+				s.use(i)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"icmp-tunnel/config"
+	"icmp-tunnel/transport"
+)
+
+const (
+	// udpReplyWait is how long a UDP request waits for the backend reply.
+	udpReplyWait = time.Second
+	// tcpReadWait is how long a TCP request waits for downstream data.
+	tcpReadWait = 50 * time.Millisecond
+	// flowIdle closes server-side sockets the agent stopped using.
+	flowIdle = 2 * time.Minute
+)
+
+// Server terminates agent flows on the sockets to the remote side of the
+// port mappings.
+type Server struct {
+	name string
+	conn io.Closer
+	done chan struct{}
+
+	mu sync.Mutex
+	// allowed holds the remote addresses agents may open new flows to
+	allowed map[string]bool
+	flows   map[flowKey]*serverFlow
+}
+
+// flowKey names a flow by the agent's host rather than its full address,
+// so a flow survives the agent falling back to another transport.
+type flowKey struct {
+	src  string
+	flow uint32
+}
+
+type serverFlow struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	lastSeen time.Time
+}
+
+// NewServer answers agents of t on every transport t.Transport lists,
+// opening sockets to the remote side of its port mappings.
+func NewServer(t *config.Tunnel) (*Server, error) {
+	key, err := t.Secret()
+	if err != nil {
+		return nil, err
+	}
+	s := newServer(t.Name)
+	if err := s.Reload(t); err != nil {
+		return nil, err
+	}
+	var lns listeners
+	for _, name := range t.TransportList() {
+		tr, err := transport.New(name, key)
+		if err != nil {
+			lns.Close()
+			return nil, err
+		}
+		ln, err := tr.Listen(t.Listen)
+		if err != nil {
+			lns.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		lns = append(lns, ln)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go serveConn(conn, s.handle)
+			}
+		}()
+	}
+	s.conn = lns
+	go func() {
+		tick := time.NewTicker(flowIdle / 4)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				s.expire(now)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// listeners closes every listener of a server.
+type listeners []net.Listener
+
+func (l listeners) Close() error {
+	var errs []error
+	for _, ln := range l {
+		errs = append(errs, ln.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func newServer(name string) *Server {
+	return &Server{
+		name:    name,
+		done:    make(chan struct{}),
+		allowed: make(map[string]bool),
+		flows:   make(map[flowKey]*serverFlow),
+	}
+}
+
+// Close stops answering agents and closes every open flow.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	for key, f := range s.flows {
+		f.conn.Close()
+		delete(s.flows, key)
+	}
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	log.Printf("[%s] server: "+format, append([]any{s.name}, args...)...)
+}
+
+// Reload replaces the set of remote addresses agents may open flows to.
+// Flows already open to a removed address drain: they keep working until
+// the agent closes them or they go idle.
+func (s *Server) Reload(t *config.Tunnel) error {
+	mappings, err := config.ParsePorts(t.Ports)
+	if err != nil {
+		return err
+	}
+	allowed := make(map[string]bool, len(mappings))
+	for _, m := range mappings {
+		allowed[m.Remote()] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr := range s.allowed {
+		if !allowed[addr] {
+			s.logf("draining flows to %s", addr)
+		}
+	}
+	for addr := range allowed {
+		if !s.allowed[addr] {
+			s.logf("accepting flows to %s", addr)
+		}
+	}
+	s.allowed = allowed
+	return nil
+}
+
+// handle answers a single agent request.
+func (s *Server) handle(src net.Addr, raw []byte) []byte {
+	r, err := unmarshalRequest(raw)
+	if err != nil {
+		return []byte{statusRefused}
+	}
+	key := flowKey{src: hostOf(src), flow: r.flow}
+
+	switch r.op {
+	case opPing:
+		return []byte{statusOK}
+	case opClose:
+		s.close(key)
+		return []byte{statusClosed}
+	case opData:
+	default:
+		return []byte{statusRefused}
+	}
+
+	f, err := s.flow(key, r)
+	if err != nil {
+		s.logf("flow %08x from %s: %v", r.flow, key.src, err)
+		return []byte{statusClosed}
+	}
+	if f == nil {
+		return []byte{statusRefused}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastSeen = time.Now()
+
+	if len(r.data) > 0 {
+		if _, err := f.conn.Write(r.data); err != nil {
+			s.close(key)
+			return []byte{statusClosed}
+		}
+	}
+
+	wait, size := tcpReadWait, maxChunk
+	if r.proto == protoUDP {
+		wait, size = udpReplyWait, maxDatagram
+	}
+	reply := make([]byte, 1+size)
+	f.conn.SetReadDeadline(time.Now().Add(wait))
+	n, err := f.conn.Read(reply[1:])
+	if err != nil && !isTimeout(err) {
+		s.close(key)
+		reply[0] = statusClosed
+	}
+	return reply[:1+n]
+}
+
+// flow returns the socket for key, dialing the remote address on first
+// use. It returns nil if the address is not an allowed mapping.
+func (s *Server) flow(key flowKey, r request) (*serverFlow, error) {
+	s.mu.Lock()
+	f, ok := s.flows[key]
+	allowed := s.allowed[r.target().Remote()]
+	s.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+	if !allowed {
+		return nil, nil
+	}
+
+	conn, err := net.DialTimeout(protoName(r.proto), r.target().Remote(), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.flows[key]; ok {
+		conn.Close()
+		return f, nil
+	}
+	f = &serverFlow{conn: conn, lastSeen: time.Now()}
+	s.flows[key] = f
+	return f, nil
+}
+
+func (s *Server) close(key flowKey) {
+	s.mu.Lock()
+	f, ok := s.flows[key]
+	delete(s.flows, key)
+	s.mu.Unlock()
+	if ok {
+		f.conn.Close()
+	}
+}
+
+// expire closes flows that have been idle for longer than flowIdle.
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, f := range s.flows {
+		if f.mu.TryLock() {
+			if now.Sub(f.lastSeen) > flowIdle {
+				f.conn.Close()
+				delete(s.flows, key)
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
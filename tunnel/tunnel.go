@@ -0,0 +1,384 @@
+// Package tunnel implements the agent and server roles started by cmd/tunnel.
+//
+// The agent listens on the local side of every port mapping and carries each
+// TCP connection or UDP peer as a flow of request/reply exchanges over the
+// configured transport. The server owns the matching socket to the remote
+// port.
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"icmp-tunnel/config"
+)
+
+// Every message on the transport starts with a tag(4) the reply repeats.
+// Request layout: op(1) + proto(1) + flow(4) + port(2) + hostLen(1) + host + data
+// Reply layout:   status(1) + data
+const (
+	opData  = 1
+	opClose = 2
+	// opPing checks that the server answers over a transport
+	opPing = 3
+)
+
+const (
+	protoTCP = 1
+	protoUDP = 2
+)
+
+const (
+	statusOK      = 0
+	statusClosed  = 1
+	statusRefused = 2
+)
+
+const (
+	tagLen           = 4
+	requestHeaderLen = 9
+)
+
+// replyTimeout bounds one exchange with the server.
+const replyTimeout = 5 * time.Second
+
+type request struct {
+	op    uint8
+	proto uint8
+	flow  uint32
+	port  uint16
+	// host is the remote host of the mapping, empty for the server itself
+	host string
+	data []byte
+}
+
+func marshalRequest(r request) []byte {
+	b := make([]byte, requestHeaderLen+len(r.host)+len(r.data))
+	b[0] = r.op
+	b[1] = r.proto
+	binary.BigEndian.PutUint32(b[2:6], r.flow)
+	binary.BigEndian.PutUint16(b[6:8], r.port)
+	b[8] = uint8(len(r.host))
+	copy(b[requestHeaderLen:], r.host)
+	copy(b[requestHeaderLen+len(r.host):], r.data)
+	return b
+}
+
+func unmarshalRequest(b []byte) (request, error) {
+	var r request
+	if len(b) < requestHeaderLen || len(b) < requestHeaderLen+int(b[8]) {
+		return r, errors.New("short request")
+	}
+	r.op = b[0]
+	r.proto = b[1]
+	r.flow = binary.BigEndian.Uint32(b[2:6])
+	r.port = binary.BigEndian.Uint16(b[6:8])
+	r.host = string(b[requestHeaderLen : requestHeaderLen+int(b[8])])
+	r.data = b[requestHeaderLen+int(b[8]):]
+	return r, nil
+}
+
+// target returns the mapping the request is for.
+func (r request) target() config.PortMapping {
+	return config.PortMapping{RemoteHost: r.host, RemotePort: r.port}
+}
+
+func protoByName(name string) (uint8, error) {
+	switch name {
+	case "tcp":
+		return protoTCP, nil
+	case "udp":
+		return protoUDP, nil
+	}
+	return 0, fmt.Errorf("unknown type %q (want \"tcp\" or \"udp\")", name)
+}
+
+func protoName(p uint8) string {
+	if p == protoUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// roundTripper delivers one request to the server and returns its reply.
+type roundTripper func(req []byte) ([]byte, error)
+
+// maxFailures is how many exchanges in a row may time out before the
+// agent gives up on its transport conn and dials again.
+const maxFailures = 3
+
+// maxMessage bounds a message on the transport: a request carrying a whole
+// UDP datagram, with its tag and longest host.
+const maxMessage = tagLen + requestHeaderLen + 255 + maxDatagram
+
+// exchanger runs the agent's exchanges over a transport conn, dialing it on
+// first use and again after it breaks. Many exchanges are in flight at
+// once, so a flow waiting on a quiet remote holds no other up; the tag
+// matches every reply to its request.
+type exchanger struct {
+	dial    func() (net.Conn, error)
+	timeout time.Duration
+	done    chan struct{}
+
+	mu       sync.Mutex
+	conn     *muxConn
+	tag      uint32
+	failures int
+	closed   bool
+}
+
+func newExchanger(dial func() (net.Conn, error)) *exchanger {
+	return &exchanger{dial: dial, timeout: replyTimeout, done: make(chan struct{})}
+}
+
+func (e *exchanger) roundTrip(req []byte) ([]byte, error) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if e.conn == nil {
+		conn, err := e.dial()
+		if err != nil {
+			e.mu.Unlock()
+			return nil, err
+		}
+		e.conn = newMuxConn(conn)
+	}
+	mc := e.conn
+	// tag 0 is left for probes
+	if e.tag++; e.tag == 0 {
+		e.tag++
+	}
+	tag := e.tag
+	e.mu.Unlock()
+
+	reply, err := mc.exchange(tag, req, e.timeout)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.failures++
+		if e.conn == mc && (!isTimeout(err) || e.failures >= maxFailures) {
+			mc.Close()
+			e.conn = nil
+			e.failures = 0
+		}
+		return nil, err
+	}
+	e.failures = 0
+	return reply, nil
+}
+
+// swap makes the exchanges continue over conn, closing the previous conn.
+// It reports false, closing conn instead, if the exchanger is closed.
+func (e *exchanger) swap(conn net.Conn) bool {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	old := e.conn
+	e.conn, e.failures = newMuxConn(conn), 0
+	e.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return true
+}
+
+func (e *exchanger) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	close(e.done)
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// muxConn is a transport conn with the exchanges waiting on it for their
+// replies, which its readLoop hands out by tag.
+type muxConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending map[uint32]chan []byte
+	err     error // why readLoop stopped
+}
+
+func newMuxConn(conn net.Conn) *muxConn {
+	m := &muxConn{Conn: conn, pending: make(map[uint32]chan []byte)}
+	go m.readLoop()
+	return m
+}
+
+// exchange sends req tagged with tag and waits up to timeout for its reply.
+func (m *muxConn) exchange(tag uint32, req []byte, timeout time.Duration) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	m.pending[tag] = ch
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, tag)
+		m.mu.Unlock()
+	}()
+
+	msg := make([]byte, tagLen+len(req))
+	binary.BigEndian.PutUint32(msg, tag)
+	copy(msg[tagLen:], req)
+	// exchanges share the deadline; each one moves it on for its own Write
+	m.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := m.Write(msg); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return nil, m.err
+		}
+		return reply, nil
+	case <-timer.C:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (m *muxConn) readLoop() {
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := m.Read(buf)
+		if err != nil {
+			m.mu.Lock()
+			m.err = err
+			for tag, ch := range m.pending {
+				close(ch)
+				delete(m.pending, tag)
+			}
+			m.mu.Unlock()
+			return
+		}
+		if n < tagLen {
+			continue
+		}
+		// a reply nobody waits for any more is dropped
+		m.mu.Lock()
+		ch, ok := m.pending[binary.BigEndian.Uint32(buf)]
+		if ok {
+			delete(m.pending, binary.BigEndian.Uint32(buf))
+			ch <- append([]byte(nil), buf[tagLen:n]...)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// exchange sends req tagged with tag over conn and waits up to timeout for
+// the reply with the same tag. It reads conn itself, so nothing else may.
+func exchange(conn net.Conn, tag uint32, req []byte, timeout time.Duration) ([]byte, error) {
+	msg := make([]byte, tagLen+len(req))
+	binary.BigEndian.PutUint32(msg, tag)
+	copy(msg[tagLen:], req)
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= tagLen && binary.BigEndian.Uint32(buf) == tag {
+			return buf[tagLen:n], nil
+		}
+	}
+}
+
+// maxFlowQueue bounds the requests of one flow waiting at the server; more
+// are dropped like lost datagrams.
+const maxFlowQueue = 64
+
+// serveConn answers the exchanges an agent sends over conn with handle
+// until the conn fails. Every flow has a goroutine of its own while it has
+// requests, which take turns, so a flow waiting on its remote holds up no
+// other.
+func serveConn(conn net.Conn, handle func(src net.Addr, req []byte) []byte) {
+	defer conn.Close()
+	var mu sync.Mutex
+	queues := make(map[uint32]chan []byte)
+	work := func(flow uint32, q chan []byte) {
+		for {
+			mu.Lock()
+			var msg []byte
+			select {
+			case msg = <-q:
+			default:
+				delete(queues, flow)
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+			reply := handle(conn.RemoteAddr(), msg[tagLen:])
+			out := make([]byte, tagLen+len(reply))
+			copy(out, msg[:tagLen])
+			copy(out[tagLen:], reply)
+			if _, err := conn.Write(out); err != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < tagLen {
+			continue
+		}
+		// requests too short to name a flow are answered as flow 0
+		var flow uint32
+		if n >= tagLen+6 {
+			flow = binary.BigEndian.Uint32(buf[tagLen+2:])
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		mu.Lock()
+		q, ok := queues[flow]
+		if !ok {
+			q = make(chan []byte, maxFlowQueue)
+			queues[flow] = q
+			go work(flow, q)
+		}
+		select {
+		case q <- msg:
+		default:
+		}
+		mu.Unlock()
+	}
+}
+
+func newFlowID() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,401 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"icmp-tunnel/config"
+)
+
+func testConfig(typ string, ports ...string) *config.Tunnel {
+	return &config.Tunnel{Name: "test", Type: typ, Ports: ports}
+}
+
+// loopback wires an agent straight to a server without the ICMP carrier.
+func loopback(t *testing.T, cfg *config.Tunnel) (*Agent, *Server) {
+	s := newServer(cfg.Name)
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("server Reload: %v", err)
+	}
+	src := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a := newAgent(cfg.Name, func(req []byte) ([]byte, error) {
+		return s.handle(src, req), nil
+	})
+	t.Cleanup(func() { a.Close() })
+	return a, s
+}
+
+func startTCPEcho(t *testing.T) int {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("backend listen: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return backend.Addr().(*net.TCPAddr).Port
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func echoOnce(conn net.Conn, msg []byte) error {
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("echoed stream does not match")
+	}
+	return nil
+}
+
+func TestForwardTCP(t *testing.T) {
+	backend := startTCPEcho(t)
+	local := freePort(t)
+	cfg := testConfig("tcp", fmt.Sprintf("127.0.0.1:%d:%d", local, backend))
+	a, _ := loopback(t, cfg)
+	if err := a.Reload(cfg); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", local))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, bytes.Repeat([]byte("forward me "), 4096)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("backend listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("ECHO: "), buf[:n]...), addr)
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+	cfg := testConfig("udp", fmt.Sprintf("127.0.0.1:%d:%d", local, backend.LocalAddr().(*net.UDPAddr).Port))
+	a, _ := loopback(t, cfg)
+	if err := a.Reload(cfg); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", local))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		if string(buf[:n]) != "ECHO: ping" {
+			t.Fatalf("unexpected reply %q", buf[:n])
+		}
+	}
+}
+
+func TestServerRefusesUnmappedPort(t *testing.T) {
+	s := newServer("test")
+	if err := s.Reload(testConfig("tcp", "1:9")); err != nil {
+		t.Fatal(err)
+	}
+	src := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	reply := s.handle(src, marshalRequest(request{op: opData, proto: protoTCP, flow: 1, port: 22}))
+	if len(reply) != 1 || reply[0] != statusRefused {
+		t.Fatalf("expected refusal, got %v", reply)
+	}
+}
+
+func TestReloadKeepsActiveSessions(t *testing.T) {
+	backend := startTCPEcho(t)
+	kept, removed, added := freePort(t), freePort(t), freePort(t)
+	mapping := func(local int) string { return fmt.Sprintf("127.0.0.1:%d:%d", local, backend) }
+
+	before := testConfig("tcp", mapping(kept), mapping(removed))
+	a, s := loopback(t, before)
+	if err := a.Reload(before); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+	dial := func(port int) (net.Conn, error) {
+		return net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	}
+	active, err := dial(removed)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer active.Close()
+	if err := echoOnce(active, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	after := testConfig("tcp", mapping(kept), mapping(added))
+	if err := a.Reload(after); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+	if err := s.Reload(after); err != nil {
+		t.Fatalf("server Reload: %v", err)
+	}
+
+	if err := echoOnce(active, []byte("still alive")); err != nil {
+		t.Fatalf("session on removed mapping was dropped: %v", err)
+	}
+	if c, err := dial(removed); err == nil {
+		c.Close()
+		t.Fatal("removed mapping still accepts connections")
+	}
+	for _, port := range []int{kept, added} {
+		c, err := dial(port)
+		if err != nil {
+			t.Fatalf("dial %d: %v", port, err)
+		}
+		if err := echoOnce(c, []byte("hello")); err != nil {
+			t.Fatalf("port %d: %v", port, err)
+		}
+		c.Close()
+	}
+}
+
+func TestReloadUDPRemoteOnly(t *testing.T) {
+	backend := func(name string) int {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("backend listen: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				pc.WriteTo(append([]byte(name+": "), buf[:n]...), addr)
+			}
+		}()
+		return pc.LocalAddr().(*net.UDPAddr).Port
+	}
+	first, second := backend("first"), backend("second")
+	local := freePort(t)
+	mapping := func(remote int) string { return fmt.Sprintf("127.0.0.1:%d:%d", local, remote) }
+
+	before := testConfig("udp", mapping(first))
+	a, s := loopback(t, before)
+	if err := a.Reload(before); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", local))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	ask := func() string {
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return string(buf[:n])
+	}
+	if got := ask(); got != "first: ping" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	after := testConfig("udp", mapping(second))
+	if err := s.Reload(after); err != nil {
+		t.Fatalf("server Reload: %v", err)
+	}
+	if err := a.Reload(after); err != nil {
+		t.Fatalf("agent Reload: %v", err)
+	}
+	if got := ask(); got != "second: ping" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestForwardOverTransports(t *testing.T) {
+	for _, tr := range append(slices.Clone(config.Transports), "icmp+faketcp") {
+		t.Run(tr, func(t *testing.T) {
+			if (strings.Contains(tr, "icmp") || strings.HasSuffix(tr, "-raw")) && os.Geteuid() != 0 {
+				t.Skip("must run as root for raw sockets")
+			}
+			backend := startTCPEcho(t)
+			local := freePort(t)
+			ports := []string{fmt.Sprintf("127.0.0.1:%d:%d", local, backend)}
+			listen := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			key := config.KeySource{Key: "transport-test-k"}
+
+			s, err := NewServer(&config.Tunnel{Name: "test", Mode: "server", Transport: tr, Listen: listen, KeySource: key, Type: "tcp", Ports: ports})
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			defer s.Close()
+			a, err := NewAgent(&config.Tunnel{Name: "test", Mode: "agent", Transport: tr, Server: listen, KeySource: key, Type: "tcp", Ports: ports})
+			if err != nil {
+				t.Fatalf("NewAgent: %v", err)
+			}
+			defer a.Close()
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", local))
+			if err != nil {
+				t.Fatalf("dial agent: %v", err)
+			}
+			defer conn.Close()
+			if err := echoOnce(conn, bytes.Repeat([]byte("over "+tr+" "), 2048)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFallbackToNextTransport(t *testing.T) {
+	backend := startTCPEcho(t)
+	local := freePort(t)
+	ports := []string{fmt.Sprintf("127.0.0.1:%d:%d", local, backend)}
+	listen := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	key := config.KeySource{Key: "transport-test-k"}
+
+	// the server only speaks udp, so the agent's faketcp handshake fails
+	s, err := NewServer(&config.Tunnel{Name: "test", Mode: "server", Transport: "udp", Listen: listen, KeySource: key, Type: "tcp", Ports: ports})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.Close()
+	a, err := NewAgent(&config.Tunnel{Name: "test", Mode: "agent", Transport: "faketcp,udp", Server: listen, KeySource: key, Type: "tcp", Ports: ports})
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	defer a.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", local))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("fell back")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangerRedialsAfterTimeouts(t *testing.T) {
+	dials := 0
+	ex := newExchanger(func() (net.Conn, error) {
+		dials++
+		c, _ := net.Pipe() // nothing ever answers
+		return c, nil
+	})
+	ex.timeout = 20 * time.Millisecond
+	defer ex.Close()
+	for i := 0; i < maxFailures; i++ {
+		if _, err := ex.roundTrip([]byte{opPing}); !isTimeout(err) {
+			t.Fatalf("roundTrip %d: want timeout, got %v", i, err)
+		}
+	}
+	if dials != 1 {
+		t.Fatalf("dialed %d times before the conn was given up, want 1", dials)
+	}
+	ex.roundTrip([]byte{opPing})
+	if dials != 2 {
+		t.Fatalf("dialed %d times, want a new conn after %d timeouts", dials, maxFailures)
+	}
+}
+
+func TestQuietFlowHoldsUpNoOther(t *testing.T) {
+	// one backend never answers, the other answers with a datagram larger
+	// than a stream chunk
+	quiet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+	big, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer big.Close()
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			_, from, err := big.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			big.WriteTo(bytes.Repeat([]byte{'x'}, 40000), from)
+		}
+	}()
+	quietPort := quiet.LocalAddr().(*net.UDPAddr).Port
+	bigPort := big.LocalAddr().(*net.UDPAddr).Port
+
+	s := newServer("test")
+	if err := s.Reload(testConfig("udp", fmt.Sprintf("1:%d", quietPort), fmt.Sprintf("2:%d", bigPort))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	agentEnd, serverEnd := net.Pipe()
+	go serveConn(serverEnd, s.handle)
+	ex := newExchanger(func() (net.Conn, error) { return agentEnd, nil })
+	defer ex.Close()
+
+	go ex.roundTrip(marshalRequest(request{op: opData, proto: protoUDP, flow: 1, port: uint16(quietPort), data: []byte("anyone?")}))
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	reply, err := ex.roundTrip(marshalRequest(request{op: opData, proto: protoUDP, flow: 2, port: uint16(bigPort), data: []byte("big")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > udpReplyWait/2 {
+		t.Errorf("reply took %v behind the quiet flow", took)
+	}
+	if len(reply) != 1+40000 || reply[0] != statusOK {
+		t.Errorf("reply: status %d, %d bytes, want 40000", reply[0], len(reply)-1)
+	}
+}
@@ -0,0 +1,343 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// handshakeTimeout bounds a WebSocket handshake when the context of Dial
+// has no deadline.
+const handshakeTimeout = 10 * time.Second
+
+// Dial opens a tunnel to the server at the "host:port" addr, over a
+// WebSocket or by long polling as opts.Mode asks.
+func Dial(ctx context.Context, addr string, opts Options) (net.Conn, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	proxy, err := opts.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode == "poll" {
+		return dialPoll(ctx, addr, proxy, opts)
+	}
+	c, err := dialWS(ctx, addr, proxy, opts)
+	if err == nil || opts.Mode == "ws" {
+		return c, err
+	}
+	pc, perr := dialPoll(ctx, addr, proxy, opts)
+	if perr != nil {
+		return nil, fmt.Errorf("%v; falling back to polling: %v", err, perr)
+	}
+	return pc, nil
+}
+
+// dialTCP connects to addr, through proxy with CONNECT unless it is nil.
+func dialTCP(ctx context.Context, addr string, proxy *url.URL) (net.Conn, *bufio.Reader, error) {
+	var d net.Dialer
+	if proxy == nil {
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, bufio.NewReader(c), nil
+	}
+	host := proxy.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	c, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("web: proxy: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("web: proxy: %v", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("web: proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, nil, fmt.Errorf("web: proxy refused CONNECT: %s", resp.Status)
+	}
+	return c, br, nil
+}
+
+// dialWS opens a WebSocket to the tunnel path at addr.
+func dialWS(ctx context.Context, addr string, proxy *url.URL, opts Options) (*wsConn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+	c, br, err := dialTCP(ctx, addr, proxy)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: opts.path()},
+		Host:   addr,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("web: websocket handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		resp.Body.Close()
+		c.Close()
+		return nil, fmt.Errorf("web: websocket handshake: %s", resp.Status)
+	}
+	if !stop() {
+		// the deadline fired as the handshake completed
+		c.Close()
+		return nil, ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
+
+	w := newWSConn(c, br, opts.Key, true)
+	go w.readLoop(nil)
+	return w, nil
+}
+
+// pollConn carries messages in the bodies of POST requests and their
+// responses. One request, the poll, waits at the server for messages; the
+// messages written go out in requests of their own.
+type pollConn struct {
+	*msgconn.Conn
+	client *http.Client
+	url    string
+	id     string // session ID
+	key    []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	out  []byte // batch of sealed messages waiting to go
+	kick chan struct{}
+}
+
+func dialPoll(ctx context.Context, addr string, proxy *url.URL, opts Options) (*pollConn, error) {
+	var sid [16]byte
+	rand.Read(sid[:])
+	u := url.URL{Scheme: "http", Host: addr, Path: opts.path(), RawQuery: "s=" + hex.EncodeToString(sid[:])}
+	tr := &http.Transport{Proxy: http.ProxyURL(proxy)}
+	p := &pollConn{
+		client: &http.Client{Transport: tr, Timeout: pollHold + 10*time.Second},
+		url:    u.String(),
+		id:     hex.EncodeToString(sid[:]),
+		key:    opts.Key,
+		kick:   make(chan struct{}, 1),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	// a first request that does not wait checks the server is there and
+	// starts the session with an empty message, which the server opens but
+	// does not deliver
+	hello, err := codec.EncryptAES(opts.Key, nil)
+	if err != nil {
+		p.cancel()
+		return nil, err
+	}
+	raddr, err := p.exchange(ctx, appendBatch(nil, hello), false)
+	if err != nil {
+		tr.CloseIdleConnections()
+		p.cancel()
+		return nil, err
+	}
+	p.Conn = msgconn.New(pollAddr(""), raddr, p.send, func() error {
+		p.cancel()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			// the server only ends a session for a request that carries
+			// its ID sealed under the key
+			sealed, err := codec.EncryptAES(p.key, []byte(p.id))
+			if err != nil {
+				tr.CloseIdleConnections()
+				return
+			}
+			body := bytes.NewReader(appendBatch(nil, sealed))
+			if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.url, body); err == nil {
+				if resp, err := p.client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+			tr.CloseIdleConnections()
+		}()
+		return nil
+	})
+	go p.pollLoop()
+	go p.sendLoop()
+	return p, nil
+}
+
+// pollAddr stands for the server of a poll conn, reached by requests that
+// may each take another connection.
+type pollAddr string
+
+func (a pollAddr) Network() string { return "http" }
+func (a pollAddr) String() string  { return string(a) }
+
+// exchange posts body and delivers the messages in the response. wait
+// lets the server hold the request until it has some.
+func (p *pollConn) exchange(ctx context.Context, body []byte, wait bool) (net.Addr, error) {
+	u := p.url
+	if !wait {
+		u += "&wait=0"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web: poll: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxBatch+maxMessage))
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := readBatch(b)
+	for _, m := range msgs {
+		if msg, err := codec.DecryptAES(p.key, m); err == nil && p.Conn != nil {
+			p.Deliver(msg)
+		}
+	}
+	return pollAddr(req.URL.Host), err
+}
+
+func (p *pollConn) send(msg []byte) error {
+	sealed, err := codec.EncryptAES(p.key, msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if len(p.out)+len(sealed) <= 4*maxBatch {
+		p.out = appendBatch(p.out, sealed)
+	}
+	p.mu.Unlock()
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendLoop posts the messages written, batching those written while a
+// request is under way.
+func (p *pollConn) sendLoop() {
+	for {
+		select {
+		case <-p.kick:
+		case <-p.ctx.Done():
+			return
+		}
+		for {
+			p.mu.Lock()
+			body := p.takeOut()
+			p.mu.Unlock()
+			if len(body) == 0 {
+				break
+			}
+			// lost like datagrams on failure; the tunnel retries
+			p.exchange(p.ctx, body, false)
+		}
+	}
+}
+
+// takeOut returns the whole messages of up to maxBatch bytes at the head
+// of p.out. p.mu must be held.
+func (p *pollConn) takeOut() []byte {
+	n := 0
+	for n < len(p.out) {
+		size := 4 + int(binary.BigEndian.Uint32(p.out[n:]))
+		if n > 0 && n+size > maxBatch {
+			break
+		}
+		n += size
+	}
+	body := p.out[:n:n]
+	p.out = p.out[n:]
+	return body
+}
+
+// pollLoop keeps a poll waiting at the server, pausing after failures.
+func (p *pollConn) pollLoop() {
+	delay := time.Duration(0)
+	for {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		if _, err := p.exchange(p.ctx, nil, true); err != nil {
+			if errors.Is(p.ctx.Err(), context.Canceled) {
+				return
+			}
+			delay = min(max(2*delay, 100*time.Millisecond), 5*time.Second)
+			continue
+		}
+		delay = 0
+	}
+}
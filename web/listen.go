@@ -0,0 +1,366 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// maxSessions bounds the poll sessions and, apart, the WebSockets a
+// listener keeps; requests for more get a 503.
+const maxSessions = 1024
+
+// Listener is an HTTP server that accepts tunnels on one path, both
+// WebSockets and poll sessions. A tunnel is only accepted once a message
+// opens under the key; a poll session only starts then, and a WebSocket
+// is closed if none does within authTimeout.
+type Listener struct {
+	ln   net.Listener
+	srv  *http.Server
+	opts Options
+
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+	sockets  map[*wsConn]bool
+}
+
+// pollSession is the server side of a long polling client.
+type pollSession struct {
+	*msgconn.Conn
+	l  *Listener
+	id string
+
+	mu       sync.Mutex
+	accepted bool
+	queued   [][]byte // sealed
+	// waiter is closed to wake the poll waiting for messages, if any
+	waiter   chan struct{}
+	lastSeen time.Time
+}
+
+// Listen serves HTTP on the TCP address addr.
+func Listen(addr string, opts Options) (*Listener, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		ln:       ln,
+		opts:     opts,
+		accept:   make(chan net.Conn, 64),
+		done:     make(chan struct{}),
+		sessions: make(map[string]*pollSession),
+		sockets:  make(map[*wsConn]bool),
+	}
+	l.srv = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+	go l.srv.Serve(ln)
+	go l.expireLoop()
+	return l, nil
+}
+
+// Accept waits for the next tunnel.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops serving and closes every tunnel.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+		l.mu.Lock()
+		var conns []net.Conn
+		for _, s := range l.sessions {
+			conns = append(conns, s)
+		}
+		for w := range l.sockets {
+			conns = append(conns, w)
+		}
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
+
+// offer hands c to Accept, closing it if the backlog is full.
+func (l *Listener) offer(c net.Conn) {
+	select {
+	case l.accept <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.opts.path() {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && headerHas(r.Header.Get("Connection"), "upgrade") && headerHas(r.Header.Get("Upgrade"), "websocket"):
+		l.upgrade(w, r)
+	case r.Method == http.MethodPost:
+		l.poll(w, r)
+	case r.Method == http.MethodDelete:
+		l.end(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// upgrade completes a WebSocket handshake and serves the tunnel over it.
+func (l *Listener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if r.Header.Get("Sec-Websocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	l.mu.Lock()
+	full := len(l.sockets) >= maxSessions
+	l.mu.Unlock()
+	if full {
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	c, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+	// the client may have sent frames along with the handshake
+	early, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil || rw.Flush() != nil {
+		c.Close()
+		return
+	}
+
+	ws := newWSConn(c, bufio.NewReader(io.MultiReader(bytes.NewReader(early), c)), l.opts.Key, false)
+	c.SetReadDeadline(time.Now().Add(authTimeout))
+	l.mu.Lock()
+	l.sockets[ws] = true
+	l.mu.Unlock()
+	go func() {
+		<-ws.Done()
+		l.mu.Lock()
+		delete(l.sockets, ws)
+		l.mu.Unlock()
+	}()
+	go ws.pingLoop()
+	go ws.readLoop(func() {
+		c.SetReadDeadline(time.Time{})
+		l.offer(ws)
+	})
+}
+
+// poll takes in the messages of a poll request and answers with the
+// messages queued for its session, waiting for some if the request
+// carried none. Empty messages only start the session.
+func (l *Listener) poll(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("s")
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatch+maxMessage))
+	if err != nil {
+		return
+	}
+	msgs, err := readBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var opened [][]byte
+	for _, m := range msgs {
+		if msg, err := codec.DecryptAES(l.opts.Key, m); err == nil {
+			opened = append(opened, msg)
+		}
+	}
+	s, full := l.session(id, r.RemoteAddr, len(opened) > 0)
+	if full {
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if len(opened) > 0 {
+		s.mu.Lock()
+		first := !s.accepted
+		s.accepted = true
+		s.mu.Unlock()
+		if first {
+			l.offer(s)
+		}
+	}
+	for _, msg := range opened {
+		if len(msg) > 0 {
+			s.Deliver(msg)
+		}
+	}
+
+	var waiter chan struct{}
+	s.mu.Lock()
+	if len(s.queued) == 0 && len(msgs) == 0 && q.Get("wait") != "0" {
+		// a newer poll takes over from the one waiting
+		if s.waiter != nil {
+			close(s.waiter)
+		}
+		waiter = make(chan struct{})
+		s.waiter = waiter
+	}
+	s.mu.Unlock()
+	if waiter != nil {
+		timer := time.NewTimer(pollHold)
+		select {
+		case <-waiter:
+		case <-timer.C:
+		case <-r.Context().Done():
+		case <-s.Done():
+		}
+		timer.Stop()
+		s.mu.Lock()
+		if s.waiter == waiter {
+			s.waiter = nil
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	var out []byte
+	for len(s.queued) > 0 && (len(out) == 0 || len(out)+4+len(s.queued[0]) <= maxBatch) {
+		out = appendBatch(out, s.queued[0])
+		s.queued = s.queued[1:]
+	}
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
+
+// session returns the poll session id, nil if there is none, starting one
+// if start is set. full reports there are too many to start another.
+func (l *Listener) session(id, remote string, start bool) (s *pollSession, full bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.sessions[id]; ok || !start {
+		return s, false
+	}
+	if len(l.sessions) >= maxSessions {
+		return nil, true
+	}
+	var raddr net.Addr = pollAddr(remote)
+	if a, err := net.ResolveTCPAddr("tcp", remote); err == nil {
+		raddr = a
+	}
+	s = &pollSession{l: l, id: id, lastSeen: time.Now()}
+	s.Conn = msgconn.New(l.ln.Addr(), raddr, s.reply, func() error {
+		l.mu.Lock()
+		if l.sessions[id] == s {
+			delete(l.sessions, id)
+		}
+		l.mu.Unlock()
+		return nil
+	})
+	l.sessions[id] = s
+	return s, false
+}
+
+// end closes the poll session of a DELETE request, which must carry the
+// session ID sealed under the key.
+func (l *Listener) end(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("s")
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatch))
+	if err != nil {
+		return
+	}
+	msgs, _ := readBatch(body)
+	for _, m := range msgs {
+		if msg, err := codec.DecryptAES(l.opts.Key, m); err == nil && string(msg) == id {
+			if s, _ := l.session(id, r.RemoteAddr, false); s != nil {
+				s.CloseWithError(io.EOF)
+			}
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// reply is the msgconn send function: it queues msg for the next poll.
+func (s *pollSession) reply(msg []byte) error {
+	sealed, err := codec.EncryptAES(s.l.opts.Key, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queued) >= maxQueued {
+		return nil
+	}
+	s.queued = append(s.queued, sealed)
+	if s.waiter != nil {
+		close(s.waiter)
+		s.waiter = nil
+	}
+	return nil
+}
+
+// expireLoop closes poll sessions that stopped polling.
+func (l *Listener) expireLoop() {
+	tick := time.NewTicker(sessionIdle / 4)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-l.done:
+			return
+		}
+		var idle []*pollSession
+		l.mu.Lock()
+		for _, s := range l.sessions {
+			s.mu.Lock()
+			if s.waiter == nil && now.Sub(s.lastSeen) > sessionIdle {
+				idle = append(idle, s)
+			}
+			s.mu.Unlock()
+		}
+		l.mu.Unlock()
+		for _, s := range idle {
+			s.Close()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package web carries messages over HTTP, for networks that only let web
+// traffic out, possibly through a proxy.
+//
+// Every message is sealed with AES-GCM by pkg.EncryptAES. A client first
+// tries a WebSocket, hand-written to RFC 6455, carrying one sealed message
+// per binary message; through a proxy it asks for the tunnel with CONNECT.
+// If the upgrade fails, as it does behind proxies that refuse CONNECT or
+// strip the Upgrade header, it falls back to long polling: plain POSTs
+// whose bodies carry batches of messages both ways, with one poll kept
+// waiting at the server for something to return.
+package web
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// pollHold is how long the server keeps a poll waiting for a message
+	// to answer with, well below the idle timeouts of common proxies.
+	pollHold = 20 * time.Second
+	// maxBatch bounds the message bytes one request or response carries.
+	maxBatch = 256 << 10
+	// maxMessage bounds one WebSocket message.
+	maxMessage = 1 << 20
+	// maxQueued bounds the messages a poll session has waiting for a poll;
+	// more are dropped.
+	maxQueued = 256
+	// sessionIdle closes poll sessions that sent no request for that long.
+	sessionIdle = 2 * time.Minute
+	// pingInterval is how often the server pings an idle WebSocket, to
+	// keep proxies from closing it.
+	pingInterval = 30 * time.Second
+)
+
+// authTimeout closes a WebSocket whose client sent no message that opens
+// under the key for that long.
+var authTimeout = 10 * time.Second
+
+// Options configures Dial and Listen. Only Key is required.
+type Options struct {
+	// Key seals messages; it must be 16, 24 or 32 bytes.
+	Key []byte
+	// Path is the URL path of the tunnel, "/" by default. Other requests
+	// get a 404.
+	Path string
+	// Mode is "ws" or "poll" to use only WebSockets or long polling. By
+	// default a client tries a WebSocket and falls back to polling.
+	Mode string
+	// Proxy is the URL of the HTTP proxy to go through, or "direct" for
+	// none. By default it comes from the HTTP_PROXY environment variable.
+	Proxy string
+}
+
+func (o Options) check() error {
+	switch len(o.Key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("web: key must be 16, 24 or 32 bytes, got %d", len(o.Key))
+	}
+	switch o.Mode {
+	case "", "ws", "poll":
+	default:
+		return fmt.Errorf("web: unknown mode %q (want \"ws\" or \"poll\")", o.Mode)
+	}
+	return nil
+}
+
+func (o Options) path() string {
+	if o.Path == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(o.Path, "/") {
+		return "/" + o.Path
+	}
+	return o.Path
+}
+
+// proxyFor returns the proxy to reach addr through, nil for none.
+func (o Options) proxyFor(addr string) (*url.URL, error) {
+	switch o.Proxy {
+	case "direct":
+		return nil, nil
+	case "":
+		return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "http", Host: addr}})
+	}
+	raw := o.Proxy
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("web: proxy: %v", err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("web: proxy: unsupported scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// A batch is the body of a poll request or response: messages, each
+// after its length as a 4 byte big-endian integer.
+
+func appendBatch(b, msg []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+var errBatch = errors.New("web: truncated batch")
+
+func readBatch(b []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return msgs, errBatch
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return msgs, errBatch
+		}
+		msgs = append(msgs, b[:n])
+		b = b[n:]
+	}
+	return msgs, nil
+}
@@ -0,0 +1,344 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("web-tunnel-key!!")
+
+// echoServer listens with opts and answers every message of every tunnel
+// with prefix+message.
+func echoServer(t *testing.T, opts Options, prefix string) *Listener {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1<<17)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(append([]byte(prefix), buf[:n]...))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func testEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	buf := make([]byte, 1<<17)
+	for _, msg := range []string{"hello", strings.Repeat("0123456789", 6000)} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "echo: "+msg {
+			t.Fatalf("reply = %.20q..., want %.20q...", buf[:n], "echo: "+msg)
+		}
+	}
+}
+
+// proxy is an HTTP proxy on loopback that forwards plain requests and,
+// if connect is set, tunnels CONNECT requests. It counts both.
+type proxy struct {
+	connect         bool
+	connects, plain atomic.Int32
+	addr            string
+}
+
+func startProxy(t *testing.T, connect bool) *proxy {
+	t.Helper()
+	p := &proxy{connect: connect}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.addr = ln.Addr().String()
+	srv := &http.Server{Handler: p}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return p
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		p.plain.Add(1)
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	p.connects.Add(1)
+	if !p.connect {
+		http.Error(w, "CONNECT not allowed", http.StatusForbidden)
+		return
+	}
+	up, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		up.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	go func() { io.Copy(up, rw); up.Close() }()
+	io.Copy(c, up)
+	c.Close()
+}
+
+func TestFrames(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, mask := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{0x5a}, n)
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, opBinary, payload, mask); err != nil {
+				t.Fatal(err)
+			}
+			fin, op, got, err := readFrame(bufio.NewReader(&buf), mask)
+			if err != nil || !fin || op != opBinary || !bytes.Equal(got, payload) {
+				t.Fatalf("%d bytes, mask %v: fin %v op %d %d bytes, %v", n, mask, fin, op, len(got), err)
+			}
+		}
+	}
+
+	// a message in two fragments with a ping between them
+	var buf bytes.Buffer
+	buf.Write([]byte{opBinary, 0x80 | 3, 0, 0, 0, 0})
+	buf.WriteString("abc")
+	writeFrame(&buf, opPing, []byte("p"), true)
+	writeFrame(&buf, opContinuation, []byte("def"), true)
+	var pings []string
+	op, msg, err := readMessage(bufio.NewReader(&buf), true, func(op byte, payload []byte) error {
+		if op == opPing {
+			pings = append(pings, string(payload))
+		}
+		return nil
+	})
+	if err != nil || op != opBinary || string(msg) != "abcdef" || len(pings) != 1 {
+		t.Fatalf("readMessage = %d %q %v, pings %q", op, msg, err, pings)
+	}
+
+	if _, _, _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0x82, 0})), true); err == nil {
+		t.Fatal("server took an unmasked frame")
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("acceptKey = %q", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	for _, mode := range []string{"ws", "poll"} {
+		t.Run(mode, func(t *testing.T) {
+			opts := Options{Key: testKey, Path: "/chat", Mode: mode, Proxy: "direct"}
+			l := echoServer(t, opts, "echo: ")
+			c, err := Dial(context.Background(), l.Addr().String(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			testEcho(t, c)
+		})
+	}
+}
+
+func TestPollPush(t *testing.T) {
+	opts := Options{Key: testKey, Mode: "poll", Proxy: "direct"}
+	l, err := Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := Dial(context.Background(), l.Addr().String(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// several messages queued at once come back in one poll response
+	buf := make([]byte, 100)
+	s.Read(buf)
+	for i := range 3 {
+		s.Write([]byte(fmt.Sprint("unasked ", i)))
+	}
+	for i := range 3 {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if want := fmt.Sprint("unasked ", i); err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read = %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestThroughProxy(t *testing.T) {
+	for _, connect := range []bool{true, false} {
+		t.Run(fmt.Sprint("connect=", connect), func(t *testing.T) {
+			p := startProxy(t, connect)
+			opts := Options{Key: testKey, Proxy: "http://" + p.addr}
+			l := echoServer(t, opts, "echo: ")
+			c, err := Dial(context.Background(), l.Addr().String(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			testEcho(t, c)
+
+			switch c.(type) {
+			case *wsConn:
+				if !connect {
+					t.Fatal("WebSocket without CONNECT")
+				}
+			case *pollConn:
+				if connect {
+					t.Fatal("fell back to polling though CONNECT works")
+				}
+				if p.plain.Load() == 0 {
+					t.Fatal("polls bypassed the proxy")
+				}
+			}
+			if p.connects.Load() != 1 {
+				t.Fatalf("%d CONNECT requests, want 1", p.connects.Load())
+			}
+		})
+	}
+}
+
+func TestOtherRequests(t *testing.T) {
+	l := echoServer(t, Options{Key: testKey, Path: "/chat"}, "")
+	for _, path := range []string{"/", "/chat"} {
+		resp, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: %s", path, resp.Status)
+		}
+	}
+
+	// a client with another key never gets a tunnel accepted
+	c, err := Dial(context.Background(), l.Addr().String(), Options{Key: []byte("another-test-key"), Path: "/chat", Proxy: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := c.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("got %d byte reply under another key", n)
+	}
+}
+
+func TestUnauthenticatedClients(t *testing.T) {
+	defer func(old time.Duration) { authTimeout = old }(authTimeout)
+	authTimeout = 100 * time.Millisecond
+	opts := Options{Key: testKey, Proxy: "direct"}
+	l := echoServer(t, opts, "echo: ")
+	count := func() (sessions, sockets int) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.sessions), len(l.sockets)
+	}
+
+	// a WebSocket under another key is dropped once authTimeout passes
+	ws, err := Dial(context.Background(), l.Addr().String(), Options{Key: []byte("another-test-key"), Mode: "ws", Proxy: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.Write([]byte("hello"))
+	deadline := time.Now().Add(2 * time.Second)
+	for _, n := count(); n > 0; _, n = count() {
+		if time.Now().After(deadline) {
+			t.Fatal("unauthenticated WebSocket kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// polls that open nothing start no session
+	url := "http://" + l.Addr().String() + "/?s="
+	for i := range 10 {
+		id := fmt.Sprintf("%032x", i)
+		resp, err := http.Post(url+id, "application/octet-stream", bytes.NewReader(appendBatch(nil, []byte("junk"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("poll %s: %s", id, resp.Status)
+		}
+	}
+	if n, _ := count(); n != 0 {
+		t.Fatalf("%d sessions started without the key", n)
+	}
+
+	// ending a session takes its ID sealed under the key
+	c, err := Dial(context.Background(), l.Addr().String(), Options{Key: testKey, Mode: "poll", Proxy: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, _ := http.NewRequest(http.MethodDelete, url+c.(*pollConn).id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	testEcho(t, c)
+	c.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for n, _ := count(); n > 0; n, _ = count() {
+		if time.Now().After(deadline) {
+			t.Fatal("session outlived its client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
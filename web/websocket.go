@@ -0,0 +1,248 @@
+package web
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"icmp-tunnel/internal/msgconn"
+	codec "icmp-tunnel/pkg"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey returns the Sec-WebSocket-Accept value for a
+// Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHas reports whether the comma-separated header value v lists
+// token, ignoring case.
+func headerHas(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFrame writes payload as one final frame. Clients mask what they
+// send, servers must not.
+func writeFrame(w io.Writer, op byte, payload []byte, mask bool) error {
+	b := make([]byte, 0, 14+len(payload))
+	b = append(b, 0x80|op)
+	var m byte
+	if mask {
+		m = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, m|byte(n))
+	case n <= 0xffff:
+		b = append(b, m|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, m|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if !mask {
+		_, err := w.Write(append(b, payload...))
+		return err
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	b = append(b, key[:]...)
+	start := len(b)
+	b = append(b, payload...)
+	for i := range payload {
+		b[start+i] ^= key[i%4]
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads one frame, requiring it be masked or not.
+func readFrame(r *bufio.Reader, masked bool) (fin bool, op byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	fin, op = h[0]&0x80 != 0, h[0]&0x0f
+	if h[0]&0x70 != 0 {
+		return fin, op, nil, errors.New("websocket: reserved bits set")
+	}
+	if (h[1]&0x80 != 0) != masked {
+		return fin, op, nil, errors.New("websocket: wrong masking")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if op&8 != 0 && (n > 125 || !fin) {
+		return fin, op, nil, errors.New("websocket: bad control frame")
+	}
+	if n > maxMessage {
+		return fin, op, nil, fmt.Errorf("websocket: %d byte frame too long", n)
+	}
+	var key [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, key[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// readMessage reads the next data message, joining its fragments, and
+// passes the control frames before and between them to control.
+func readMessage(r *bufio.Reader, masked bool, control func(op byte, payload []byte) error) (op byte, msg []byte, err error) {
+	for {
+		fin, fop, payload, err := readFrame(r, masked)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case fop&8 != 0:
+			if err := control(fop, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case fop == opContinuation && op == 0, fop != opContinuation && op != 0:
+			return 0, nil, errors.New("websocket: bad fragmentation")
+		case fop != opContinuation:
+			op = fop
+		}
+		if len(msg)+len(payload) > maxMessage {
+			return 0, nil, errors.New("websocket: message too long")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// wsConn carries sealed messages in the binary messages of a WebSocket.
+type wsConn struct {
+	*msgconn.Conn
+	c      net.Conn
+	br     *bufio.Reader
+	key    []byte
+	client bool
+
+	wmu sync.Mutex
+}
+
+func newWSConn(c net.Conn, br *bufio.Reader, key []byte, client bool) *wsConn {
+	w := &wsConn{c: c, br: br, key: key, client: client}
+	w.Conn = msgconn.New(c.LocalAddr(), c.RemoteAddr(), w.send, func() error {
+		w.write(opClose, binary.BigEndian.AppendUint16(nil, 1000))
+		return c.Close()
+	})
+	return w
+}
+
+func (w *wsConn) write(op byte, payload []byte) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	w.c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeFrame(w.c, op, payload, w.client)
+}
+
+func (w *wsConn) send(msg []byte) error {
+	sealed, err := codec.EncryptAES(w.key, msg)
+	if err != nil {
+		return err
+	}
+	return w.write(opBinary, sealed)
+}
+
+// readLoop delivers the messages of the peer until the WebSocket closes.
+// first, if set, runs on the first message that opens under the key.
+func (w *wsConn) readLoop(first func()) {
+	control := func(op byte, payload []byte) error {
+		switch op {
+		case opPing:
+			return w.write(opPong, payload)
+		case opClose:
+			return io.EOF
+		}
+		return nil
+	}
+	for {
+		op, msg, err := readMessage(w.br, !w.client, control)
+		if err != nil {
+			w.CloseWithError(io.EOF)
+			return
+		}
+		if op != opBinary {
+			continue
+		}
+		if msg, err = codec.DecryptAES(w.key, msg); err != nil {
+			continue
+		}
+		if first != nil {
+			first()
+			first = nil
+		}
+		w.Deliver(msg)
+	}
+}
+
+// pingLoop pings the peer every pingInterval until the conn closes.
+func (w *wsConn) pingLoop() {
+	tick := time.NewTicker(pingInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if w.write(opPing, nil) != nil {
+				return
+			}
+		case <-w.Done():
+			return
+		}
+	}
+}